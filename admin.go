@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+const refreshSecretHeader = "X-Refresh-Secret"
+
+type refreshHandler struct{}
+
+type assetsHandler struct{}
+
+// authorized tells whether the request carries the shared secret.
+func authorized(r *http.Request) bool {
+	secret := r.Header.Get(refreshSecretHeader)
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(*flagRefreshSecret)) == 1
+}
+
+// clientCertHandler only lets through requests made with a TLS client
+// certificate verified against the admin CA.
+type clientCertHandler struct {
+	next http.Handler
+}
+
+func (h *clientCertHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		writeStatus(w, http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// adminTLSConfig creates a TLS config verifying the client certificates
+// given against the CA certificates in caFile. Clients without a certificate
+// are accepted, clientCertHandler turns them away from admin endpoints.
+func adminTLSConfig(caFile string) (*tls.Config, error) {
+	certs, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certs) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+func writeStatus(w http.ResponseWriter, status int) {
+	w.WriteHeader(status)
+	w.Write([]byte(http.StatusText(status)))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+// writeError answers with status and a JSON args.Error body.
+func writeError(w http.ResponseWriter, status int, code args.ErrorCode, message string) {
+	content, err := json.Marshal(&args.Error{Code: code, Message: message})
+	if err != nil {
+		writeStatus(w, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+func (h *refreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeStatus(w, http.StatusNotFound)
+		return
+	}
+
+	if !authorized(r) {
+		writeStatus(w, http.StatusForbidden)
+		return
+	}
+
+	// Don't wait for a background refresh retrying.
+	interruptRefresh()
+	summary, err := updateAssets(r.Context())
+	if err != nil {
+		log.Printf("Refresh failed with error: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, summary)
+}
+
+func (h *assetsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeStatus(w, http.StatusNotFound)
+		return
+	}
+
+	if !authorized(r) {
+		writeStatus(w, http.StatusForbidden)
+		return
+	}
+
+	m, err := apps.Get(r.URL.Query().Get("app"))
+	if err != nil {
+		writeStatus(w, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, m.ListAssets())
+}
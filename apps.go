@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+// AppRegistry routes update checks to the ReleaseManager of the application
+// they are for.
+type AppRegistry struct {
+	managers   map[string]*ReleaseManager
+	order      []string
+	defaultApp string
+	mu         sync.RWMutex
+}
+
+// NewAppRegistry creates an empty registry.
+func NewAppRegistry() *AppRegistry {
+	return &AppRegistry{
+		managers: make(map[string]*ReleaseManager),
+	}
+}
+
+// Register adds an application. The first registered application serves
+// clients that do not send an app id.
+func (a *AppRegistry) Register(appID string, m *ReleaseManager) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.managers[appID]; !ok {
+		a.order = append(a.order, appID)
+	}
+	a.managers[appID] = m
+	if a.defaultApp == "" {
+		a.defaultApp = appID
+	}
+}
+
+// Get returns the ReleaseManager of an application, or the default one if
+// appID is empty.
+func (a *AppRegistry) Get(appID string) (*ReleaseManager, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if appID == "" {
+		appID = a.defaultApp
+	}
+	m := a.managers[appID]
+	if m == nil {
+		return nil, newCheckError(args.ERROR_UNKNOWN_APP, "No such app: %q", appID)
+	}
+	return m, nil
+}
+
+// Each calls fn for every registered application, in registration order.
+func (a *AppRegistry) Each(fn func(appID string, m *ReleaseManager)) {
+	a.mu.RLock()
+	order := make([]string, len(a.order))
+	copy(order, a.order)
+	a.mu.RUnlock()
+
+	for _, appID := range order {
+		m, _ := a.Get(appID)
+		fn(appID, m)
+	}
+}
+
+// Refresh refreshes all registered applications. It keeps going when one of
+// them fails and returns the first error.
+func (a *AppRegistry) Refresh(ctx context.Context) (summary *RefreshSummary, err error) {
+	a.mu.RLock()
+	order := make([]string, len(a.order))
+	copy(order, a.order)
+	a.mu.RUnlock()
+
+	summary = new(RefreshSummary)
+	for _, appID := range order {
+		m, _ := a.Get(appID)
+		s, e := m.Refresh(ctx)
+		if e != nil {
+			log.Printf("Refreshing app %q failed: %s", appID, e)
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		summary.Releases += s.Releases
+		summary.Assets += s.Assets
+		summary.Failed += s.Failed
+	}
+	return summary, err
+}
+
+// Pregenerate pregenerates the patches of all registered applications. It
+// keeps going when one of them fails and returns the first error.
+func (a *AppRegistry) Pregenerate(ctx context.Context) (n int, err error) {
+	a.Each(func(appID string, m *ReleaseManager) {
+		c, e := m.Pregenerate(ctx)
+		n += c
+		if e != nil {
+			log.Printf("Pregenerating patches of app %q failed: %s", appID, e)
+			if err == nil {
+				err = e
+			}
+		}
+	})
+	return n, err
+}
+
+// LocalFiles returns the set of local files of the assets of all registered
+// applications.
+func (a *AppRegistry) LocalFiles() map[string]bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	files := make(map[string]bool)
+	for _, m := range a.managers {
+		for file := range m.LocalFiles() {
+			files[file] = true
+		}
+	}
+	return files
+}
+
+// CheckForUpdate routes params to the ReleaseManager of the application they
+// name.
+func (a *AppRegistry) CheckForUpdate(ctx context.Context, p *args.Params) (*args.Result, error) {
+	if p == nil {
+		return nil, newCheckError(args.ERROR_MISSING_PARAMS, "Expecting params")
+	}
+	m, err := a.Get(p.AppId)
+	if err != nil {
+		return nil, err
+	}
+	return m.CheckForUpdate(ctx, p)
+}
+
+// parseApps parses a comma separated list of appid=owner/repo entries.
+func parseApps(s string) (map[string][2]string, error) {
+	apps := make(map[string][2]string)
+	if s == "" {
+		return apps, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expecting appid=owner/repo, got %q", entry)
+		}
+		repo := strings.SplitN(parts[1], "/", 2)
+		if parts[0] == "" || len(repo) != 2 || repo[0] == "" || repo[1] == "" {
+			return nil, fmt.Errorf("expecting appid=owner/repo, got %q", entry)
+		}
+		apps[parts[0]] = [2]string{repo[0], repo[1]}
+	}
+	return apps, nil
+}
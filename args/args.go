@@ -9,12 +9,46 @@ const (
 	INITIATIVE_MANUAL            = "manual"
 )
 
-// PatchType represents the type of a binary patch, if any. Only bsdiff is supported
+// PatchType represents the type of a binary patch, if any: bsdiff, optionally
+// compressed with zstd, or courgette.
 type PatchType string
 
 const (
-	PATCHTYPE_BSDIFF PatchType = "bsdiff"
-	PATCHTYPE_NONE             = ""
+	PATCHTYPE_BSDIFF      PatchType = "bsdiff"
+	PATCHTYPE_BSDIFF_ZSTD PatchType = "bsdiff+zstd"
+	PATCHTYPE_COURGETTE   PatchType = "courgette"
+	PATCHTYPE_NONE                  = ""
+)
+
+// ChecksumAlgorithm is the hash function checksums are computed with.
+type ChecksumAlgorithm string
+
+const (
+	CHECKSUM_SHA256 ChecksumAlgorithm = "sha256"
+	CHECKSUM_SHA512 ChecksumAlgorithm = "sha512"
+)
+
+// ErrorCode identifies why an update check failed.
+type ErrorCode string
+
+const (
+	ERROR_BAD_REQUEST          ErrorCode = "bad_request"
+	ERROR_NOT_FOUND            ErrorCode = "not_found"
+	ERROR_METHOD_NOT_ALLOWED   ErrorCode = "method_not_allowed"
+	ERROR_MISSING_PARAMS       ErrorCode = "missing_params"
+	ERROR_UNKNOWN_APP          ErrorCode = "unknown_app"
+	ERROR_BAD_VERSION          ErrorCode = "bad_version"
+	ERROR_MISSING_CHECKSUM     ErrorCode = "missing_checksum"
+	ERROR_BAD_CHECKSUM_ALGO    ErrorCode = "bad_checksum_algorithm"
+	ERROR_MISSING_OS           ErrorCode = "missing_os"
+	ERROR_MISSING_ARCH         ErrorCode = "missing_arch"
+	ERROR_BAD_OS               ErrorCode = "bad_os"
+	ERROR_BAD_ARCH             ErrorCode = "bad_arch"
+	ERROR_NO_RELEASE           ErrorCode = "no_release"
+	ERROR_NOT_READY            ErrorCode = "not_ready"
+	ERROR_UNSUPPORTED_PLATFORM ErrorCode = "unsupported_platform"
+	ERROR_PATCH_FAILED         ErrorCode = "patch_failed"
+	ERROR_INTERNAL             ErrorCode = "internal"
 )
 
 // Params represent parameters sent by the go-update client.
@@ -22,7 +56,7 @@ type Params struct {
 	// protocol version
 	Version int `json:"version"`
 	// identifier of the application to update
-	//AppId string `json:"app_id"`
+	AppId string `json:"app_id"`
 
 	// version of the application updating itself
 	AppVersion string `json:"app_version"`
@@ -30,12 +64,30 @@ type Params struct {
 	OS string `json:"os"`
 	// hardware architecture of target platform
 	Arch string `json:"arch"`
+	// version of the operating system, e.g. 11.2 (empty means unknown)
+	OSVersion string `json:"os_version"`
 	// application-level user identifier
-	//UserId string `json:"user_id"`
+	UserId string `json:"user_id"`
 	// checksum of the binary to replace (used for returning diff patches)
 	Checksum string `json:"checksum"`
+	// version of the binary to replace, preferred over checksum to find it
+	// when known to the server
+	FromVersion string `json:"from_version"`
+	// algorithm of the checksum (empty string means 'sha256')
+	ChecksumAlgorithm ChecksumAlgorithm `json:"checksum_algorithm"`
 	// release channel (empty string means 'stable')
-	//Channel string `json:"-"`
+	Channel string `json:"channel"`
+	// release channels to try in order, the first with an update is used,
+	// e.g. ["beta", "stable"] (takes precedence over channel)
+	Channels []string `json:"channels"`
+	// patch types supported by the client (empty means bsdiff only)
+	PatchTypes []PatchType `json:"patch_types"`
+	// whether to include the release title and notes in the result
+	WithNotes bool `json:"with_notes"`
+	// whether the client can apply a chain of patches
+	ChainedPatches bool `json:"chained_patches"`
+	// whether to only tell about the update, without generating the patch
+	MetadataOnly bool `json:"metadata_only"`
 	// tags for custom update channels
 	Tags map[string]string `json:"tags"`
 }
@@ -48,12 +100,51 @@ type Result struct {
 	URL string `json:"url"`
 	// a URL to a patch to apply
 	PatchURL string `json:"patch_url"`
-	// the patch format (only bsdiff supported at the moment)
+	// the patch format: bsdiff, bsdiff+zstd or courgette, none for a full
+	// download
 	PatchType PatchType `json:"patch_type"`
 	// version of the new application
 	Version string `json:"version"`
+	// channel the update was found on, when several were asked for
+	Channel string `json:"channel,omitempty"`
 	// expected checksum of the new application
 	Checksum string `json:"checksum"`
+	// algorithm of the checksum
+	ChecksumAlgorithm ChecksumAlgorithm `json:"checksum_algorithm"`
 	// signature for verifying update authenticity
 	Signature string `json:"signature"`
+	// signatures by ID of the signing key, when the server signs with
+	// several keys to rotate them
+	Signatures map[string]string `json:"signatures,omitempty"`
+	// patches to apply in order instead of the one at PatchURL, when they are
+	// smaller altogether
+	PatchChain []ChainedPatch `json:"patch_chain,omitempty"`
+	// title of the release, if asked for
+	Title string `json:"title,omitempty"`
+	// notes of the release, if asked for
+	Notes string `json:"notes,omitempty"`
+	// whether the update must be applied without letting the user postpone it
+	Mandatory bool `json:"mandatory,omitempty"`
+}
+
+// ChainedPatch is a patch of a chain, leading to an intermediate version or
+// to the update.
+type ChainedPatch struct {
+	// a URL to the patch
+	PatchURL string `json:"patch_url"`
+	// the patch format
+	PatchType PatchType `json:"patch_type"`
+	// version the patch leads to
+	Version string `json:"version"`
+	// expected checksum of the patched application, with the algorithm of
+	// the result
+	Checksum string `json:"checksum"`
+}
+
+// Error represents the answer sent to the client when an update check fails.
+type Error struct {
+	// what went wrong
+	Code ErrorCode `json:"code"`
+	// human readable description
+	Message string `json:"message"`
 }
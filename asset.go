@@ -2,17 +2,52 @@ package main
 
 import (
 	"compress/bzip2"
+	"context"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	downloadRetries      = 5
+	downloadRetryBackoff = time.Second
+)
+
+var (
+	// downloadClient is the HTTP client assets are downloaded with.
+	downloadClient = http.DefaultClient
+	// downloadTimeout bounds the time spent downloading an asset, retries
+	// included. Zero means no limit.
+	downloadTimeout time.Duration
+	// maxAssetSize is the largest asset, in bytes, that is downloaded. Zero
+	// means no limit.
+	maxAssetSize int64
+)
+
+// verifiedAssets remembers the size and modification time of the local assets
+// known to match their recorded checksum, so that they are not hashed again on
+// every patch generation unless they change.
+var verifiedAssets = struct {
+	sync.Mutex
+	files map[string]os.FileInfo
+}{files: make(map[string]os.FileInfo)}
+
 // downloadAsset grabs the contents of the body of the given URL and stores
-// then into $ASSETS_DIRECTORY/$BASENAME.SHA256_SUM($URL)
-func downloadAsset(uri string, assetDir string) (localfile string, err error) {
+// then into $ASSETS_DIRECTORY/$BASENAME.SHA256_SUM($URL). If size is positive
+// the download fails unless exactly size bytes were received, and if digest is
+// not empty unless they have this SHA-256 checksum. Interrupted downloads are
+// resumed and transient failures retried until ctx is done or downloadTimeout
+// elapses; a download not matching digest is started over once.
+func downloadAsset(ctx context.Context, uri string, assetDir string, size int64, digest string) (localfile string, err error) {
 	basename := path.Base(uri)
 	fileExt := path.Ext(basename)
 
@@ -26,39 +61,293 @@ func downloadAsset(uri string, assetDir string) (localfile string, err error) {
 
 	localfile = assetDir + fmt.Sprintf("%s.%x", basename, sha256.Sum256([]byte(uri)))
 
-	if !fileExists(localfile) {
-		var body io.Reader
-		var res *http.Response
+	if fileExists(localfile) && assetVerified(localfile) {
+		return localfile, nil
+	}
+
+	if maxAssetSize > 0 && size > maxAssetSize {
+		return "", ErrAssetTooLarge
+	}
+
+	if downloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, downloadTimeout)
+		defer cancel()
+	}
+
+	partfile := localfile + ".part"
 
-		if res, err = http.Get(uri); err != nil {
+	// Another instance may have downloaded it already.
+	if found, err := fetchFile(assetStorage, path.Base(localfile), partfile); err != nil {
+		log.Printf("Could not get %s from storage: %q", localfile, err)
+	} else if found && checkDigest(partfile, digest) != nil {
+		log.Printf("Copy of %s in storage does not match its checksum, downloading it again", localfile)
+		os.Remove(partfile)
+	} else if found {
+		if err = finishAsset(partfile, localfile, false); err != nil {
 			return "", err
 		}
+		return localfile, nil
+	}
 
-		if res.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("Expecting 200 OK, got: %s", res.Status)
+	backoff := downloadRetryBackoff
+	restarted := false
+	for i := 1; ; i++ {
+		var retry bool
+		if retry, err = fetchAsset(ctx, uri, partfile, size); err == nil {
+			if err = checkDigest(partfile, digest); err == nil {
+				break
+			}
+			os.Remove(partfile)
+			if restarted {
+				return "", err
+			}
+			// Whatever was resumed is corrupt, start over once.
+			log.Printf("Downloading %s failed, starting over: %q", uri, err)
+			restarted = true
+			continue
+		}
+		if !retry || i == downloadRetries {
+			return "", err
 		}
+		log.Printf("Downloading %s failed, retrying in %s: %q", uri, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		backoff *= 2
+	}
 
-		defer res.Body.Close()
+	if err = finishAsset(partfile, localfile, fileExt == ".bz2"); err != nil {
+		return "", err
+	}
 
-		var fp *os.File
+	publishFile(assetStorage, localfile)
 
-		if fp, err = os.Create(localfile); err != nil {
-			return "", err
+	return localfile, nil
+}
+
+// checkDigest returns an error unless file has the given SHA-256 checksum, if
+// any.
+func checkDigest(file string, digest string) error {
+	if digest == "" {
+		return nil
+	}
+	checksum, _, err := checksumForFile(file)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(checksum, digest) {
+		return fmt.Errorf("Expecting SHA-256 checksum %s, got %s", digest, checksum)
+	}
+	return nil
+}
+
+// fetchDigest downloads the file holding the SHA-256 checksum of an asset, as
+// written by sha256sum, and returns the checksum.
+func fetchDigest(ctx context.Context, uri string) (digest string, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, "GET", uri, nil); err != nil {
+		return "", err
+	}
+
+	var res *http.Response
+	if res, err = downloadClient.Do(req); err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Expecting 200 OK, got: %s", res.Status)
+	}
+
+	var b []byte
+	if b, err = ioutil.ReadAll(io.LimitReader(res.Body, 4096)); err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 || len(fields[0]) != 2*sha256.Size {
+		return "", fmt.Errorf("No SHA-256 checksum in %s", uri)
+	}
+	if _, err = hex.DecodeString(fields[0]); err != nil {
+		return "", fmt.Errorf("No SHA-256 checksum in %s", uri)
+	}
+	return fields[0], nil
+}
+
+// fetchAsset downloads the given URL into partfile, resuming from whatever
+// partfile already holds. It tells whether a failed download is worth
+// retrying.
+func fetchAsset(ctx context.Context, uri string, partfile string, size int64) (retry bool, err error) {
+	var offset int64
+	if fi, err := os.Stat(partfile); err == nil {
+		offset = fi.Size()
+	}
+
+	if size > 0 {
+		if offset == size {
+			// Already complete.
+			return false, nil
+		}
+		if offset > size {
+			os.Remove(partfile)
+			offset = 0
 		}
+	}
 
-		defer fp.Close()
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, "GET", uri, nil); err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 
-		if fileExt == ".bz2" {
-			body = bzip2.NewReader(res.Body)
-		} else {
-			body = res.Body
+	var res *http.Response
+	if res, err = downloadClient.Do(req); err != nil {
+		return ctx.Err() == nil, err
+	}
+
+	defer res.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch res.StatusCode {
+	case http.StatusOK:
+		// Whole content, either no range was asked or it was ignored.
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is of no use, start over.
+		os.Remove(partfile)
+		return true, fmt.Errorf("Expecting 200 OK, got: %s", res.Status)
+	default:
+		retry = res.StatusCode >= 500 ||
+			res.StatusCode == http.StatusRequestTimeout ||
+			res.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("Expecting 200 OK, got: %s", res.Status)
+	}
+
+	var fp *os.File
+
+	if fp, err = os.OpenFile(partfile, flags, 0644); err != nil {
+		return false, err
+	}
+
+	defer fp.Close()
+
+	var body io.Reader = res.Body
+	if maxAssetSize > 0 {
+		body = io.LimitReader(body, maxAssetSize-offset+1)
+	}
+
+	var n int64
+	if n, err = io.Copy(fp, body); err != nil {
+		return ctx.Err() == nil, err
+	}
+
+	if maxAssetSize > 0 && offset+n > maxAssetSize {
+		os.Remove(partfile)
+		return false, ErrAssetTooLarge
+	}
+
+	if size > 0 && offset+n != size {
+		os.Remove(partfile)
+		return true, fmt.Errorf("Expecting %d bytes, got %d from %s", size, offset+n, uri)
+	}
+
+	return false, nil
+}
+
+// finishAsset moves a completed download into place, decompressing it if
+// needed, and records its checksum so it is not downloaded again.
+func finishAsset(partfile string, localfile string, compressed bool) (err error) {
+	if compressed {
+		var in, out *os.File
+
+		if in, err = os.Open(partfile); err != nil {
+			return err
 		}
 
-		if _, err = io.Copy(fp, body); err != nil {
-			return "", err
+		defer in.Close()
+
+		if out, err = os.Create(localfile); err != nil {
+			return err
 		}
 
+		defer out.Close()
+
+		var body io.Reader = bzip2.NewReader(in)
+		if maxAssetSize > 0 {
+			body = io.LimitReader(body, maxAssetSize+1)
+		}
+
+		var n int64
+		if n, err = io.Copy(out, body); err == nil && maxAssetSize > 0 && n > maxAssetSize {
+			err = ErrAssetTooLarge
+		}
+		if err != nil {
+			os.Remove(localfile)
+			os.Remove(partfile)
+			return err
+		}
+
+		os.Remove(partfile)
+	} else {
+		if err = os.Rename(partfile, localfile); err != nil {
+			return err
+		}
 	}
 
-	return localfile, nil
+	var checksum string
+	if checksum, _, err = checksumForFile(localfile); err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(localfile+".sha256", []byte(checksum), 0644); err != nil {
+		return err
+	}
+	rememberVerified(localfile)
+	return nil
+}
+
+// rememberVerified records that localfile, as it is now, matches its checksum.
+func rememberVerified(localfile string) {
+	fi, err := os.Stat(localfile)
+	if err != nil {
+		return
+	}
+	verifiedAssets.Lock()
+	defer verifiedAssets.Unlock()
+	verifiedAssets.files[localfile] = fi
+}
+
+// assetVerified tells whether a local asset matches the checksum recorded
+// when it was downloaded. Assets are only hashed again if their size or
+// modification time changed since they were last found to match.
+func assetVerified(localfile string) bool {
+	fi, err := os.Stat(localfile)
+	if err != nil {
+		return false
+	}
+	verifiedAssets.Lock()
+	known := verifiedAssets.files[localfile]
+	verifiedAssets.Unlock()
+	if known != nil && known.Size() == fi.Size() && known.ModTime().Equal(fi.ModTime()) {
+		return true
+	}
+
+	expected, err := ioutil.ReadFile(localfile + ".sha256")
+	if err != nil {
+		return false
+	}
+	checksum, _, err := checksumForFile(localfile)
+	if err != nil || checksum != string(expected) {
+		return false
+	}
+	rememberVerified(localfile)
+	return true
 }
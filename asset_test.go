@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAssetVerifiedOnlyHashesChangedFiles(t *testing.T) {
+	repo := newTestRepo(t)
+	asset := repo.release(1, "1.0.0", "linux_amd64").Assets[0]
+
+	localfile, err := downloadAsset(context.Background(), asset.URL, repo.manager.assetDir, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(localfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size and modification time, it is not hashed again.
+	corrupt := make([]byte, fi.Size())
+	if err = ioutil.WriteFile(localfile, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(localfile, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if !assetVerified(localfile) {
+		t.Error("Unchanged asset hashed again")
+	}
+
+	// Modified, it is.
+	later := fi.ModTime().Add(time.Second)
+	if err = os.Chtimes(localfile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if assetVerified(localfile) {
+		t.Error("Corrupt asset verified")
+	}
+}
+
+func TestResumedAssetCheckedAgainstSidecar(t *testing.T) {
+	repo := newTestRepo(t)
+	rel := repo.release(1, "1.0.0", "linux_amd64")
+	asset := &rel.Assets[0]
+	binary := testBinary("linux_amd64", "1.0.0")
+	asset.size = int64(len(binary))
+
+	// The sidecar is served along the asset, and is no update itself.
+	repo.mu.Lock()
+	repo.files["/1.0.0/update_linux_amd64.sha256"] = []byte(testChecksum(binary) + "  update_linux_amd64\n")
+	repo.mu.Unlock()
+	rel.Assets = append(rel.Assets, Asset{id: 101, Name: asset.Name + ".sha256", URL: asset.URL + ".sha256"})
+
+	// An earlier download left a part file of the right size, but corrupt.
+	partfile := repo.manager.assetDir + fmt.Sprintf("%s.%x", asset.Name, sha256.Sum256([]byte(asset.URL))) + ".part"
+	if err := ioutil.WriteFile(partfile, make([]byte, len(binary)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repo.source.set(rel)
+	summary, err := repo.manager.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Failed != 0 || summary.Assets != 1 {
+		t.Fatalf("Refresh: %+v", summary)
+	}
+	served := repo.manager.knownAsset("linux", "amd64", "1.0.0")
+	if served == nil || served.Checksum != testChecksum(binary) {
+		t.Fatalf("Served %+v, want the published asset", served)
+	}
+
+	// An asset never matching its sidecar is not served.
+	rel = repo.release(2, "1.1.0", "linux_amd64")
+	repo.mu.Lock()
+	repo.files["/1.1.0/update_linux_amd64.sha256"] = []byte(testChecksum(binary))
+	repo.mu.Unlock()
+	rel.Assets = append(rel.Assets, Asset{id: 201, Name: rel.Assets[0].Name + ".sha256", URL: rel.Assets[0].URL + ".sha256"})
+	repo.source.set(rel)
+	if summary, err = repo.manager.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Failed != 1 {
+		t.Fatalf("Refresh: %+v", summary)
+	}
+}
@@ -1,23 +1,61 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
-	generatePatchMu sync.Mutex
+	// patchSlots bounds the number of patches generated concurrently.
+	patchSlots = make(chan struct{}, 1)
+	// waitForPatchSlot tells whether to wait for a free slot or give up with
+	// ErrPatchBusy.
+	waitForPatchSlot = true
+	// patchDirMu is read-locked while generating patches and locked while
+	// removing them.
+	patchDirMu sync.RWMutex
+	// verifyPatches tells whether patches are checked to reproduce their
+	// target before being served.
+	verifyPatches = true
+	// verifiedPatches holds the patches known to reproduce their target.
+	verifiedPatches   = make(map[string]bool)
+	verifiedPatchesMu sync.Mutex
+	// patchGroup coalesces concurrent generations of the same patch.
+	patchGroup flightGroup
+	// maxPatchChain is the most patches offered in a chain through
+	// intermediate versions, chains are not offered if less than 2.
+	maxPatchChain = 0
+	// maxPatchRatio is the largest size of a patch relative to its target
+	// offered, a full download is offered instead of larger patches. There is
+	// no limit if 0.
+	maxPatchRatio = 0.8
+	// patchTmpDir holds the intermediate files of patch generation, the
+	// patch directory does if empty.
+	patchTmpDir = ""
+	// noPatches tells whether to offer full downloads only, never generating
+	// patches.
+	noPatches = false
 )
 
-// Patch struct is a representation of a patch generated by bsdiff.
+// Patch struct is a representation of a patch generated by a Patcher.
 type Patch struct {
 	oldfile string
 	newfile string
+	patcher Patcher
 	File    string
 }
 
@@ -28,6 +66,98 @@ func fileExists(s string) bool {
 	return false
 }
 
+// fileSize returns the size of a file, or -1 if it cannot be determined.
+func fileSize(s string) int64 {
+	fi, err := os.Stat(s)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+// dirPath makes sure dir ends with a path separator, so that file names can
+// be appended to it.
+func dirPath(dir string) string {
+	if !strings.HasSuffix(dir, string(filepath.Separator)) && !strings.HasSuffix(dir, "/") {
+		dir += string(filepath.Separator)
+	}
+	return dir
+}
+
+// checkServed checks that a file written to dir, as patches are, is found in
+// st when it is the disk storage the patches handler serves from.
+func checkServed(st Storage, dir string) error {
+	if _, ok := st.(*diskStorage); !ok {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(dir, ".served-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	found, err := st.Exists(filepath.Base(tmp.Name()))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("files written to %s are not served", dir)
+	}
+	return nil
+}
+
+// scratchDir returns the directory for the intermediate files of patches
+// stored in dir.
+func scratchDir(dir string) string {
+	if patchTmpDir != "" {
+		return patchTmpDir
+	}
+	return dir
+}
+
+// moveFile moves src to dst, copying it if they are on different volumes.
+// dst appears complete or not at all.
+func moveFile(src string, dst string) (err error) {
+	if err = os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(filepath.Dir(dst), ".move-"); err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// checkWritable makes sure files can be created in dir.
+func checkWritable(dir string) error {
+	tmp, err := ioutil.TempFile(dir, ".check-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
 func dirExists(dir string) bool {
 	fi, err := os.Stat(dir)
 	if err != nil {
@@ -58,7 +188,7 @@ func fileHash(s string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func bspatch(oldfile string, newfile string, patchfile string) (err error) {
+func applyPatch(patcher Patcher, oldfile string, newfile string, patchfile string) (err error) {
 	if !fileExists(oldfile) {
 		return fmt.Errorf("File %s does not exist.", oldfile)
 	}
@@ -67,21 +197,10 @@ func bspatch(oldfile string, newfile string, patchfile string) (err error) {
 		return fmt.Errorf("File %s does not exist.", oldfile)
 	}
 
-	cmd := exec.Command(
-		"bspatch",
-		oldfile,
-		newfile,
-		patchfile,
-	)
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Failed to apply patch with bspatch: %q", err)
-	}
-
-	return nil
+	return patcher.Apply(oldfile, newfile, patchfile)
 }
 
-func bsdiff(oldfile string, newfile string, patchDir string) (patchfile string, err error) {
+func diff(ctx context.Context, patcher Patcher, oldfile string, newfile string, patchDir string) (patchfile string, err error) {
 
 	if !fileExists(oldfile) {
 		return "", fmt.Errorf("File %s does not exist.", oldfile)
@@ -94,45 +213,256 @@ func bsdiff(oldfile string, newfile string, patchDir string) (patchfile string,
 	oldfileHash := fileHash(oldfile)
 	newfileHash := fileHash(newfile)
 
-	patchfile = patchDir + fmt.Sprintf("%x", sha256.Sum256([]byte(oldfileHash+"|"+newfileHash)))
+	key := oldfileHash + "|" + newfileHash
+	if patcher.Type() != args.PATCHTYPE_BSDIFF {
+		key += "|" + string(patcher.Type())
+	}
+	patchfile = patchDir + fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
 
 	if fileExists(patchfile) {
-		// Patch already exists, no need to compute it again.
+		// Patch already exists, no need to compute it again. Touch it so it
+		// is not reaped while still in use.
+		now := time.Now()
+		os.Chtimes(patchfile, now, now)
 		return patchfile, nil
 	}
 
-	cmd := exec.Command(
-		"bsdiff",
-		oldfile,
-		newfile,
+	// Write to a temporary file first, the same patch may be generated
+	// concurrently.
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(scratchDir(patchDir), ".diff-"); err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// Another instance may have generated it already.
+	if found, err := fetchFile(patchStorage, path.Base(patchfile), tmp.Name()); err != nil {
+		log.Printf("Could not get %s from storage: %q", patchfile, err)
+	} else if found {
+		return patchfile, moveFile(tmp.Name(), patchfile)
+	}
+
+	if err = patcher.Diff(ctx, oldfile, newfile, tmp.Name()); err != nil {
+		return "", err
+	}
+
+	if err = moveFile(tmp.Name(), patchfile); err != nil {
+		return "", err
+	}
+
+	publishPatch(patchfile)
+
+	return patchfile, nil
+}
+
+// verifyPatch applies a patch to its old file and checks the result matches
+// the given SHA256 checksum. A patch that does not is removed, from the patch
+// storage too so that it is generated again rather than fetched back.
+func verifyPatch(p *Patch, checksum string) (err error) {
+	key := filepath.Clean(p.File)
+
+	verifiedPatchesMu.Lock()
+	verified := verifiedPatches[key]
+	verifiedPatchesMu.Unlock()
+	if verified {
+		return nil
+	}
+
+	patchDirMu.RLock()
+	defer patchDirMu.RUnlock()
+
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(scratchDir(path.Dir(p.File)), ".patch-"); err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err = applyPatch(p.patcher, p.oldfile, tmp.Name(), p.File); err != nil {
+		return err
+	}
+
+	var patched string
+	if patched, _, err = checksumForFile(tmp.Name()); err != nil {
+		return err
+	}
+
+	if patched != checksum {
+		patchLRU.forget(p.File)
+		os.Remove(p.File)
+		if e := patchStorage.Delete(path.Base(p.File)); e != nil {
+			logger.Warn("Could not delete bad patch from storage", "name", path.Base(p.File), "error", e)
+		}
+		return fmt.Errorf("Patched file checksum %s, expecting %s", patched, checksum)
+	}
+
+	verifiedPatchesMu.Lock()
+	verifiedPatches[key] = true
+	verifiedPatchesMu.Unlock()
+
+	return nil
+}
+
+// zstdCompress compresses a patch with zstd and returns the compressed file.
+// Compressing takes a patch slot, it gives up and kills zstd when ctx is done.
+func zstdCompress(ctx context.Context, patchfile string) (zstdfile string, err error) {
+	zstdfile = patchfile + ".zst"
+	if compressedPatch(zstdfile) {
+		return zstdfile, nil
+	}
+
+	// The slot is taken before locking the patch directory, as when
+	// generating patches.
+	if err = acquirePatchSlot(ctx); err != nil {
+		return "", err
+	}
+	defer releasePatchSlot()
+
+	patchDirMu.RLock()
+	defer patchDirMu.RUnlock()
+
+	if fileExists(zstdfile) {
+		// Compressed meanwhile.
+		patchLRU.touch(zstdfile, fileSize(zstdfile))
+		return zstdfile, nil
+	}
+
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(scratchDir(path.Dir(patchfile)), ".zstd-"); err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if found, err := fetchFile(patchStorage, path.Base(zstdfile), tmp.Name()); err != nil {
+		log.Printf("Could not get %s from storage: %q", zstdfile, err)
+	} else if found {
+		return zstdfile, moveFile(tmp.Name(), zstdfile)
+	}
+
+	cmd := exec.CommandContext(
+		ctx,
+		"zstd",
+		"-q",
+		"-f",
+		"-19",
+		"-o",
+		tmp.Name(),
 		patchfile,
 	)
 
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("Failed to generate patch with bsdiff: %q", err)
+		return "", fmt.Errorf("Failed to compress patch with zstd: %q", err)
 	}
 
-	return patchfile, nil
+	if err = moveFile(tmp.Name(), zstdfile); err != nil {
+		return "", err
+	}
+
+	publishPatch(zstdfile)
+	patchLRU.touch(zstdfile, fileSize(zstdfile))
+
+	return zstdfile, nil
+}
+
+// compressedPatch tells whether zstdfile was already compressed, marking it
+// as used if so.
+func compressedPatch(zstdfile string) bool {
+	patchDirMu.RLock()
+	defer patchDirMu.RUnlock()
+
+	if !fileExists(zstdfile) {
+		return false
+	}
+	now := time.Now()
+	os.Chtimes(zstdfile, now, now)
+	patchLRU.touch(zstdfile, fileSize(zstdfile))
+	return true
 }
 
-// generatePatch compares the contents of two URLs and generates a patch.
-func generatePatch(oldfileURL string, newfileURL string, assetDir string, patchDir string) (p *Patch, err error) {
-	generatePatchMu.Lock()
-	defer generatePatchMu.Unlock()
+// acquirePatchSlot takes one of the -patch-jobs slots, waiting for it until
+// ctx is done with -patch-wait or else returning ErrPatchBusy if none is
+// free.
+func acquirePatchSlot(ctx context.Context) error {
+	if waitForPatchSlot {
+		select {
+		case patchSlots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case patchSlots <- struct{}{}:
+		return nil
+	default:
+		return ErrPatchBusy
+	}
+}
 
-	p = new(Patch)
+// releasePatchSlot frees a slot taken with acquirePatchSlot.
+func releasePatchSlot() {
+	<-patchSlots
+}
 
-	if p.oldfile, err = downloadAsset(oldfileURL, assetDir); err != nil {
+// setMaxPatchJobs sets how many patches may be generated at once and whether
+// to wait for a free slot.
+func setMaxPatchJobs(n int, wait bool) {
+	patchSlots = make(chan struct{}, n)
+	waitForPatchSlot = wait
+}
+
+// generatePatch compares the contents of two URLs and generates a patch with
+// patcher. It gives up when ctx is done.
+func generatePatch(ctx context.Context, patcher Patcher, oldfileURL string, newfileURL string, assetDir string, patchDir string) (p *Patch, err error) {
+	if err = acquirePatchSlot(ctx); err != nil {
 		return nil, err
 	}
+	defer releasePatchSlot()
+
+	patchDirMu.RLock()
+	defer patchDirMu.RUnlock()
+	defer observePatchDuration(time.Now())
 
-	if p.newfile, err = downloadAsset(newfileURL, assetDir); err != nil {
+	p = &Patch{patcher: patcher}
+
+	if p.oldfile, err = downloadAsset(ctx, oldfileURL, assetDir, 0, ""); err != nil {
 		return nil, err
 	}
 
-	if p.File, err = bsdiff(p.oldfile, p.newfile, patchDir); err != nil {
+	if p.newfile, err = downloadAsset(ctx, newfileURL, assetDir, 0, ""); err != nil {
 		return nil, err
 	}
 
+	if p.File, err = diff(ctx, patcher, p.oldfile, p.newfile, patchDir); err != nil {
+		return nil, err
+	}
+	patchLRU.touch(p.File, fileSize(p.File))
+
 	return p, nil
 }
+
+// generatePatchFor generates the patch going from one asset to another with
+// patcher. Concurrent calls for the same pair of assets share a single
+// generation.
+func generatePatchFor(ctx context.Context, patcher Patcher, from *Asset, to *Asset, assetDir string, patchDir string) (patch *Patch, err error) {
+	ctx, span := tracer.Start(ctx, "generate patch")
+	span.SetAttributes(
+		attribute.String("from_version", from.v.String()),
+		attribute.String("to_version", to.v.String()),
+		attribute.String("patch_type", string(patcher.Type())),
+	)
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	key := from.Checksum + "|" + to.Checksum + "|" + patchDir + "|" + string(patcher.Type())
+	v, err := patchGroup.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return generatePatch(ctx, patcher, from.URL, to.URL, assetDir, patchDir)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Patch), nil
+}
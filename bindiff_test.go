@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestBadPatchDeletedFromStorage(t *testing.T) {
+	repo := newTestRepo(t)
+	from := repo.release(1, "1.0.0", "linux_amd64").Assets[0]
+	to := repo.release(2, "1.1.0", "linux_amd64").Assets[0]
+	checksum := testChecksum(testBinary("linux_amd64", "1.1.0"))
+	store := &diskStorage{dir: t.TempDir() + "/"}
+	patchStorage = store
+
+	generate := func() *Patch {
+		p, err := generatePatch(context.Background(), refPatcher{}, from.URL, to.URL, repo.manager.assetDir, repo.manager.patchDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	p := generate()
+	name := path.Base(p.File)
+	if err := verifyPatch(p, checksum); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stored copy goes bad, another instance fetches it.
+	if err := ioutil.WriteFile(store.path(name), []byte(p.oldfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(p.File)
+	verifiedPatchesMu.Lock()
+	delete(verifiedPatches, filepath.Clean(p.File))
+	verifiedPatchesMu.Unlock()
+
+	if err := verifyPatch(generate(), checksum); err == nil {
+		t.Fatal("Bad patch verified")
+	}
+	if found, _ := store.Exists(name); found {
+		t.Error("Bad patch still stored")
+	}
+
+	// A good patch is generated again.
+	if err := verifyPatch(generate(), checksum); err != nil {
+		t.Errorf("Patch generated again does not verify: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+// assetCache is the on-disk form of the assets known to a ReleaseManager.
+type assetCache struct {
+	// KeyFingerprint identifies the keys the signatures were made with.
+	KeyFingerprint string        `json:"key_fingerprint"`
+	Assets         []cachedAsset `json:"assets"`
+}
+
+type cachedAsset struct {
+	ID         int                               `json:"id"`
+	Version    string                            `json:"version"`
+	Rollout    int                               `json:"rollout"`
+	Ramp       *rampSchedule                     `json:"ramp,omitempty"`
+	Mandatory  bool                              `json:"mandatory,omitempty"`
+	Published  time.Time                         `json:"published"`
+	MinOS      string                            `json:"min_os,omitempty"`
+	Size       int64                             `json:"size"`
+	Title      string                            `json:"title"`
+	Notes      string                            `json:"notes"`
+	Channel    string                            `json:"channel"`
+	Name       string                            `json:"name"`
+	URL        string                            `json:"url"`
+	LocalFile  string                            `json:"local_file"`
+	Checksums  map[args.ChecksumAlgorithm]string `json:"checksums"`
+	Signature  string                            `json:"signature"`
+	Signatures map[string]string                 `json:"signatures,omitempty"`
+	OS         string                            `json:"os"`
+	Arch       string                            `json:"arch"`
+}
+
+// minOSString formats a minimum OS version, empty if there is none.
+func minOSString(v semver.Version) string {
+	if v.Equals(emptyVersion) {
+		return ""
+	}
+	return v.String()
+}
+
+// cacheFile is where the assets of the repository are cached.
+func (g *ReleaseManager) cacheFile() string {
+	return g.assetDir + fmt.Sprintf("assets-%s-%s.json", g.owner, g.repo)
+}
+
+// keyFingerprint identifies the signing keys.
+func (g *ReleaseManager) keyFingerprint() string {
+	fingerprints := make([]string, 0, len(g.signers))
+	for _, signer := range g.signers {
+		der, err := x509.MarshalPKIXPublicKey(signer.Public())
+		if err != nil {
+			return ""
+		}
+		fingerprints = append(fingerprints, fmt.Sprintf("%x", sha256.Sum256(der)))
+	}
+	return strings.Join(fingerprints, ",")
+}
+
+// saveCache writes the known assets to the cache file.
+func (g *ReleaseManager) saveCache() error {
+	if dryRun {
+		return nil
+	}
+
+	g.mu.RLock()
+	cache := assetCache{KeyFingerprint: g.keyFingerprint()}
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			for _, a := range g.updateAssetsMap[os][arch] {
+				cache.Assets = append(cache.Assets, cachedAsset{
+					ID:         a.id,
+					Version:    a.v.String(),
+					Rollout:    a.rollout,
+					Ramp:       a.ramp,
+					Mandatory:  a.mandatory,
+					Published:  a.published,
+					MinOS:      minOSString(a.minOS),
+					Size:       a.size,
+					Title:      a.title,
+					Notes:      a.notes,
+					Channel:    a.channel,
+					Name:       a.Name,
+					URL:        a.URL,
+					LocalFile:  a.LocalFile,
+					Checksums:  a.checksums,
+					Signature:  a.Signature,
+					Signatures: a.signatures,
+					OS:         a.OS,
+					Arch:       a.Arch,
+				})
+			}
+		}
+	}
+	g.mu.RUnlock()
+
+	content, err := json.Marshal(&cache)
+	if err != nil {
+		return err
+	}
+
+	tmp := g.cacheFile() + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g.cacheFile())
+}
+
+// LoadCache reads the assets known before a restart from the cache file.
+// Assets whose local file is gone or was modified are left out, as well as
+// all assets if they were signed with another key.
+func (g *ReleaseManager) LoadCache() error {
+	content, err := ioutil.ReadFile(g.cacheFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var cache assetCache
+	if err = json.Unmarshal(content, &cache); err != nil {
+		return err
+	}
+
+	if cache.KeyFingerprint != g.keyFingerprint() {
+		logger.Warn("Ignoring asset cache signed with another key", "file", g.cacheFile())
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, c := range cache.Assets {
+		v, err := semver.Parse(c.Version)
+		if err != nil {
+			continue
+		}
+		if c.Channel == "" {
+			// Cached before channels were stored.
+			c.Channel = channelOf(v)
+		}
+		var minOS semver.Version
+		if c.MinOS != "" {
+			if minOS, err = semver.Parse(c.MinOS); err != nil {
+				continue
+			}
+		}
+		checksum, _, err := checksumForFile(c.LocalFile)
+		if err != nil || checksum != c.Checksums[args.CHECKSUM_SHA256] {
+			logger.Warn("Ignoring cached asset whose local file changed", "name", c.Name, "file", c.LocalFile)
+			continue
+		}
+		g.storeAsset(c.OS, c.Arch, &Asset{
+			id:         c.ID,
+			v:          v,
+			rollout:    c.Rollout,
+			ramp:       c.Ramp,
+			mandatory:  c.Mandatory,
+			published:  c.Published,
+			minOS:      minOS,
+			size:       c.Size,
+			title:      c.Title,
+			notes:      c.Notes,
+			channel:    c.Channel,
+			Name:       c.Name,
+			URL:        c.URL,
+			LocalFile:  c.LocalFile,
+			Checksum:   checksum,
+			Signature:  c.Signature,
+			signatures: c.Signatures,
+			checksums:  c.Checksums,
+			AssetInfo:  AssetInfo{OS: c.OS, Arch: c.Arch},
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// AssetClassifier tells update assets apart from the other assets of a
+// release, such as installers, and finds their platform.
+type AssetClassifier interface {
+	// IsUpdate tells whether the named asset is an update.
+	IsUpdate(name string) bool
+	// Info returns the platform, and version if any, of the named update
+	// asset.
+	Info(name string) (*AssetInfo, error)
+}
+
+// assetClassifier classifies the assets of all releases, see -asset-pattern.
+// Other naming conventions can be supported by setting it to another
+// AssetClassifier.
+var assetClassifier AssetClassifier = &regexpClassifier{re: defaultAssetRe()}
+
+// defaultAssetRe recognizes update assets named update_<os>_<arch>, with any
+// of knownOSes and knownArchs.
+func defaultAssetRe() *regexp.Regexp {
+	return regexp.MustCompile(`^update_(?P<os>` + alternation(knownOSes) + `)_(?P<arch>` + alternation(knownArchs) + `)\.?.*$`)
+}
+
+// regexpClassifier recognizes update assets with a regexp having os and
+// arch named groups, and optionally a version one.
+type regexpClassifier struct {
+	re *regexp.Regexp
+}
+
+func (c *regexpClassifier) IsUpdate(name string) bool {
+	return c.re.MatchString(name)
+}
+
+func (c *regexpClassifier) Info(name string) (*AssetInfo, error) {
+	matches := c.re.FindStringSubmatch(name)
+	if matches == nil {
+		return nil, fmt.Errorf("Could not find asset info.")
+	}
+	group := func(name string) string {
+		if i := c.re.SubexpIndex(name); i >= 0 {
+			return matches[i]
+		}
+		return ""
+	}
+	info := &AssetInfo{
+		OS:      group("os"),
+		Arch:    group("arch"),
+		version: group("version"),
+	}
+	if !contains(knownOSes, info.OS) {
+		return nil, fmt.Errorf("Unknown OS: \"%s\".", info.OS)
+	}
+	if !contains(knownArchs, info.Arch) {
+		return nil, fmt.Errorf("Unknown architecture \"%s\".", info.Arch)
+	}
+	return info, nil
+}
+
+// compileAssetPattern compiles a pattern update assets are recognized with.
+// It must have "os" and "arch" named groups, and may have a "version" one.
+func compileAssetPattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range []string{"os", "arch"} {
+		if re.SubexpIndex(group) < 0 {
+			return nil, fmt.Errorf("missing (?P<%s>...) group", group)
+		}
+	}
+	return re, nil
+}
+
+// setAssetPattern replaces the pattern update assets are recognized with.
+func setAssetPattern(pattern string) error {
+	re, err := compileAssetPattern(pattern)
+	if err != nil {
+		return err
+	}
+	assetClassifier = &regexpClassifier{re: re}
+	return nil
+}
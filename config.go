@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Config holds settings read from a JSON config file, YAML is not supported.
+// Each field corresponds to a command line flag, which takes precedence when
+// given. Only the flags listed in configFlags can be set from the file.
+type Config struct {
+	PrivateKey      string `json:"private_key"`
+	PublicKey       string `json:"public_key"`
+	ExtraKeys       string `json:"extra_keys"`
+	LocalAddr       string `json:"local_addr"`
+	PublicAddr      string `json:"public_addr"`
+	Organization    string `json:"organization"`
+	Project         string `json:"project"`
+	AssetDir        string `json:"asset_dir"`
+	PatchDir        string `json:"patch_dir"`
+	RefreshInterval string `json:"refresh_interval"`
+	Token           string `json:"token"`
+	GithubURL       string `json:"github_url"`
+	Provider        string `json:"provider"`
+	GitlabURL       string `json:"gitlab_url"`
+	Manifest        string `json:"manifest"`
+	Proxy           string `json:"proxy"`
+	ExtraOS         string `json:"extra_os"`
+	AssetPattern    string `json:"asset_pattern"`
+	Storage         string `json:"storage"`
+	S3Endpoint      string `json:"s3_endpoint"`
+	S3Bucket        string `json:"s3_bucket"`
+	S3AccessKey     string `json:"s3_access_key"`
+	S3SecretKey     string `json:"s3_secret_key"`
+	S3PublicURL     string `json:"s3_public_url"`
+	Apps            string `json:"apps"`
+	LogFormat       string `json:"log_format"`
+}
+
+// configFlags maps config fields to flag names.
+var configFlags = []struct {
+	field string
+	flag  string
+}{
+	{"private_key", "k"},
+	{"public_key", "pubkey"},
+	{"extra_keys", "extra-keys"},
+	{"local_addr", "l"},
+	{"public_addr", "p"},
+	{"organization", "o"},
+	{"project", "n"},
+	{"asset_dir", "asset"},
+	{"patch_dir", "patch"},
+	{"refresh_interval", "refresh"},
+	{"token", "token"},
+	{"github_url", "github-url"},
+	{"provider", "provider"},
+	{"gitlab_url", "gitlab-url"},
+	{"manifest", "manifest"},
+	{"proxy", "proxy"},
+	{"extra_os", "extra-os"},
+	{"asset_pattern", "asset-pattern"},
+	{"storage", "storage"},
+	{"s3_endpoint", "s3-endpoint"},
+	{"s3_bucket", "s3-bucket"},
+	{"s3_access_key", "s3-access-key"},
+	{"s3_secret_key", "s3-secret-key"},
+	{"s3_public_url", "s3-public-url"},
+	{"apps", "apps"},
+	{"log_format", "log-format"},
+}
+
+func (c *Config) fields() map[string]string {
+	return map[string]string{
+		"private_key":      c.PrivateKey,
+		"public_key":       c.PublicKey,
+		"extra_keys":       c.ExtraKeys,
+		"local_addr":       c.LocalAddr,
+		"public_addr":      c.PublicAddr,
+		"organization":     c.Organization,
+		"project":          c.Project,
+		"asset_dir":        c.AssetDir,
+		"patch_dir":        c.PatchDir,
+		"refresh_interval": c.RefreshInterval,
+		"token":            c.Token,
+		"github_url":       c.GithubURL,
+		"provider":         c.Provider,
+		"gitlab_url":       c.GitlabURL,
+		"manifest":         c.Manifest,
+		"proxy":            c.Proxy,
+		"extra_os":         c.ExtraOS,
+		"asset_pattern":    c.AssetPattern,
+		"storage":          c.Storage,
+		"s3_endpoint":      c.S3Endpoint,
+		"s3_bucket":        c.S3Bucket,
+		"s3_access_key":    c.S3AccessKey,
+		"s3_secret_key":    c.S3SecretKey,
+		"s3_public_url":    c.S3PublicURL,
+		"apps":             c.Apps,
+		"log_format":       c.LogFormat,
+	}
+}
+
+// loadConfig reads a JSON config file.
+func loadConfig(filename string) (*Config, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var c Config
+	decoder := json.NewDecoder(fp)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&c); err != nil {
+		if e, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, fmt.Errorf("invalid value for field %q: expecting %s", e.Field, e.Type)
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// commandLineFlags are the flags explicitly given on the command line, they
+// are recorded before the config is first applied.
+var commandLineFlags map[string]bool
+
+// applyConfig sets flags from the config, skipping flags explicitly given on
+// the command line. Flags the config does not set are set back to their
+// defaults, so that removing a setting from the file and reloading it undoes
+// the setting.
+func applyConfig(c *Config) error {
+	if commandLineFlags == nil {
+		commandLineFlags = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			commandLineFlags[f.Name] = true
+		})
+	}
+	given := commandLineFlags
+
+	values := c.fields()
+	for _, cf := range configFlags {
+		value := values[cf.field]
+		if given[cf.flag] {
+			continue
+		}
+		if value == "" {
+			value = flag.Lookup(cf.flag).DefValue
+		}
+		if err := flag.Set(cf.flag, value); err != nil {
+			return fmt.Errorf("invalid value for field %q: %s", cf.field, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestApplyConfigResetsRemovedFields(t *testing.T) {
+	saved, savedGiven := flagValues(), commandLineFlags
+	t.Cleanup(func() {
+		restoreFlags(saved)
+		commandLineFlags = savedGiven
+	})
+	// -token was given on the command line.
+	commandLineFlags = map[string]bool{"token": true}
+	flag.Set("token", "from-command-line")
+
+	if err := applyConfig(&Config{RefreshInterval: "30m", Proxy: "http://proxy:3128", Token: "from-file"}); err != nil {
+		t.Fatal(err)
+	}
+	if *flagRefreshInterval != 30*time.Minute || *flagProxy != "http://proxy:3128" || *flagGithubToken != "from-command-line" {
+		t.Fatalf("after the first load: -refresh %s, -proxy %q, -token %q", *flagRefreshInterval, *flagProxy, *flagGithubToken)
+	}
+
+	// The proxy is removed from the file.
+	if err := applyConfig(&Config{RefreshInterval: "30m"}); err != nil {
+		t.Fatal(err)
+	}
+	if *flagProxy != flag.Lookup("proxy").DefValue {
+		t.Errorf("-proxy = %q once removed, want the default %q", *flagProxy, flag.Lookup("proxy").DefValue)
+	}
+	if *flagRefreshInterval != 30*time.Minute || *flagGithubToken != "from-command-line" {
+		t.Errorf("after the reload: -refresh %s, -token %q", *flagRefreshInterval, *flagGithubToken)
+	}
+}
@@ -2,10 +2,49 @@ package main
 
 import (
 	"errors"
+	"fmt"
+
+	"github.com/yinghuocho/autoupdate-server/args"
 )
 
 // Public errors
 var (
 	ErrNoSuchAsset       = errors.New(`No such asset with the given checksum`)
 	ErrNoUpdateAvailable = errors.New(`No update available`)
+	ErrPatchBusy         = errors.New(`Too many patches being generated`)
+	ErrAssetTooLarge     = errors.New(`Asset is too large`)
+	ErrNotModified       = errors.New(`Releases not modified`)
+	// ErrNotReady means releases were not loaded yet, clients should retry.
+	ErrNotReady = errors.New(`Releases not loaded yet`)
+	// ErrUnsupportedPlatform means no release has assets for the OS and
+	// architecture.
+	ErrUnsupportedPlatform = errors.New(`Unsupported platform`)
 )
+
+// checkError is an update check failure that is reported to the client.
+type checkError struct {
+	code args.ErrorCode
+	msg  string
+}
+
+func (e *checkError) Error() string {
+	return e.msg
+}
+
+func newCheckError(code args.ErrorCode, format string, a ...interface{}) error {
+	return &checkError{code: code, msg: fmt.Sprintf(format, a...)}
+}
+
+// errorCode returns the code reported to clients for err.
+func errorCode(err error) args.ErrorCode {
+	if e, ok := err.(*checkError); ok {
+		return e.code
+	}
+	switch err {
+	case ErrNotReady:
+		return args.ERROR_NOT_READY
+	case ErrUnsupportedPlatform:
+		return args.ERROR_UNSUPPORTED_PLATFORM
+	}
+	return args.ERROR_INTERNAL
+}
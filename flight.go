@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// flightCall represents a computation that is in flight or has completed.
+type flightCall struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup coalesces concurrent calls sharing the same key so that only
+// one of them does the actual work and the rest wait for its result. Unlike
+// golang.org/x/sync/singleflight it hands fn a context that is cancelled once
+// every caller has given up, so an abandoned patch generation frees its slot
+// instead of running to completion for nobody.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flightCall
+}
+
+// Do executes fn for the given key unless a call with the same key is already
+// in flight, in which case it waits for that call and returns its result.
+// A caller stops waiting when its ctx is done, and fn's context is cancelled
+// once no caller is waiting anymore. fn's context carries the span context of
+// the caller that started the call, so its spans join that caller's trace.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flightCall)
+	}
+	c, ok := g.m[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx)))
+		c = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.m[key] = c
+		go func() {
+			c.val, c.err = fn(fctx)
+			g.mu.Lock()
+			if g.m[key] == c {
+				delete(g.m, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Nobody wants the result anymore.
+			c.cancel()
+			if g.m[key] == c {
+				delete(g.m, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
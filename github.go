@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// ReleaseLister lists the releases of a repository. It is implemented by
+// github.RepositoriesService.
+type ReleaseLister interface {
+	ListReleases(owner, repo string, opt *github.ListOptions) ([]github.RepositoryRelease, *github.Response, error)
+}
+
+// includeDrafts tells whether draft releases are listed, they are skipped by
+// default.
+var includeDrafts bool
+
+// replayedHeader is set on responses replayed by etagTransport.
+const replayedHeader = "X-Replayed"
+
+// etagEntry is a response remembered by etagTransport.
+type etagEntry struct {
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+// etagTransport makes GET requests conditional on the ETag of the last
+// response to the same URL, and replays that response when the server
+// answers 304 Not Modified. GitHub does not count those against the rate
+// limit.
+type etagTransport struct {
+	base http.RoundTripper
+
+	mu    sync.Mutex
+	cache map[string]*etagEntry
+}
+
+func (t *etagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return t.base.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+	t.mu.Lock()
+	entry := t.cache[key]
+	t.mu.Unlock()
+
+	r := req
+	if entry != nil {
+		r = req.Clone(req.Context())
+		r.Header.Set("If-None-Match", entry.etag)
+	}
+
+	res, err := t.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotModified && entry != nil:
+		res.Body.Close()
+		header := entry.header.Clone()
+		// Rate limit headers are up to date.
+		for k, v := range res.Header {
+			if strings.HasPrefix(k, "X-Ratelimit-") {
+				header[k] = v
+			}
+		}
+		header.Set(replayedHeader, "true")
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         res.Proto,
+			ProtoMajor:    res.ProtoMajor,
+			ProtoMinor:    res.ProtoMinor,
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+			ContentLength: int64(len(entry.body)),
+			Request:       req,
+		}, nil
+	case res.StatusCode == http.StatusOK && res.Header.Get("ETag") != "":
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		t.mu.Lock()
+		if t.cache == nil {
+			t.cache = make(map[string]*etagEntry)
+		}
+		t.cache[key] = &etagEntry{etag: res.Header.Get("ETag"), header: res.Header.Clone(), body: body}
+		t.mu.Unlock()
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return res, nil
+}
+
+// githubSource is a ReleaseSource listing GitHub releases.
+type githubSource struct {
+	client ReleaseLister
+}
+
+// Releases pages through all releases of owner/repo. It returns
+// ErrNotModified if no page changed since the last call.
+func (s *githubSource) Releases(owner, repo string) ([]Release, error) {
+	var releases []Release
+	modified := false
+
+	for page := 1; true; page++ {
+		opt := &github.ListOptions{Page: page}
+
+		rels, res, err := s.client.ListReleases(owner, repo, opt)
+
+		if res != nil {
+			githubRateRemaining.Set(float64(res.Remaining))
+			if res.Response == nil || res.Header.Get(replayedHeader) == "" {
+				modified = true
+			}
+		}
+
+		if err != nil {
+			githubErrorsTotal.Inc()
+			if rle, ok := err.(*github.RateLimitError); ok {
+				githubRateRemaining.Set(0)
+				logger.Warn("GitHub API rate limit exceeded", "limit", rle.Rate.Limit, "reset", rle.Rate.Reset.Time)
+			}
+			return nil, err
+		}
+
+		if len(rels) == 0 {
+			break
+		}
+
+		for i := range rels {
+			if rels[i].TagName == nil || rels[i].ID == nil {
+				log.Printf("Release %d has no tag or ID. Skipping.", i)
+				continue
+			}
+			if rels[i].Draft != nil && *rels[i].Draft && !includeDrafts {
+				log.Printf("Release %q is a draft. Skipping.", *rels[i].TagName)
+				continue
+			}
+			version := *rels[i].TagName
+			rel := Release{
+				id:        *rels[i].ID,
+				Tag:       version,
+				Rollout:   fullRollout,
+				Published: publishedAt(&rels[i]),
+			}
+			if rels[i].ZipballURL != nil {
+				rel.URL = *rels[i].ZipballURL
+			}
+			if rels[i].Body != nil {
+				rel.Rollout = parseRollout(*rels[i].Body)
+				rel.Ramp = parseRamp(*rels[i].Body, publishedAt(&rels[i]))
+				rel.Mandatory = parseMandatory(*rels[i].Body)
+				rel.Notes = *rels[i].Body
+			}
+			if rels[i].Name != nil {
+				rel.Title = *rels[i].Name
+			}
+			if rels[i].Prerelease != nil {
+				rel.Prerelease = *rels[i].Prerelease
+			}
+			rel.Assets = make([]Asset, 0, len(rels[i].Assets))
+			for _, asset := range rels[i].Assets {
+				if asset.ID == nil || asset.Name == nil || asset.BrowserDownloadURL == nil {
+					log.Printf("Release %q has an asset without ID, name or download URL. Skipping.", version)
+					continue
+				}
+				a := Asset{
+					id:   *asset.ID,
+					Name: *asset.Name,
+					URL:  *asset.BrowserDownloadURL,
+				}
+				if asset.Size != nil {
+					a.size = int64(*asset.Size)
+				}
+				rel.Assets = append(rel.Assets, a)
+			}
+			logger.Info("Found release", "version", version, "assets", len(rel.Assets))
+			releases = append(releases, rel)
+		}
+	}
+
+	if !modified {
+		return nil, ErrNotModified
+	}
+
+	return releases, nil
+}
+
+// publishedAt tells when a release was published, or created if it was not.
+func publishedAt(rel *github.RepositoryRelease) time.Time {
+	if rel.PublishedAt != nil {
+		return rel.PublishedAt.Time
+	}
+	if rel.CreatedAt != nil {
+		return rel.CreatedAt.Time
+	}
+	return time.Time{}
+}
+
+// tokenTransport authenticates requests to host with an API token, sent with
+// scheme in the Authorization header. Requests to other hosts, such as
+// redirects to a CDN, are left untouched.
+type tokenTransport struct {
+	token  string
+	scheme string
+	host   string
+	base   http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", t.scheme+" "+t.token)
+	return t.base.RoundTrip(r)
+}
+
+// userAgentTransport sets the User-Agent of requests.
+type userAgentTransport struct {
+	agent string
+	base  http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.Header.Set("User-Agent", t.agent)
+	return t.base.RoundTrip(r)
+}
+
+// userAgent builds the User-Agent of outbound requests from the server
+// version and suffix, if any.
+func userAgent(suffix string) string {
+	agent := "autoupdate-server/" + version
+	if suffix != "" {
+		agent += " " + suffix
+	}
+	return agent
+}
+
+// rateLimitReset tells when the rate limit that made err happen resets, if
+// it is a GitHub rate limit error.
+func rateLimitReset(err error) (reset time.Time, ok bool) {
+	var rle *github.RateLimitError
+	if !errors.As(err, &rle) {
+		return time.Time{}, false
+	}
+	return rle.Rate.Reset.Time, true
+}
+
+// newTransport creates the transport for outbound requests. It goes through
+// proxy if given, or through the proxy set by the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables.
+func newTransport(proxy string) (http.RoundTripper, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	return t, nil
+}
+
+// newHTTPClient creates an HTTP client using base that authenticates
+// requests to host if a token is given.
+func newHTTPClient(base http.RoundTripper, token string, host string) *http.Client {
+	if token == "" {
+		return &http.Client{Transport: base}
+	}
+	return &http.Client{
+		Transport: &tokenTransport{token: token, scheme: "token", host: host, base: base},
+	}
+}
+
+// enterpriseURLs returns the API and upload URLs of a GitHub Enterprise
+// instance given its address.
+func enterpriseURLs(addr string) (baseURL *url.URL, uploadURL *url.URL, err error) {
+	if baseURL, err = url.Parse(addr); err != nil {
+		return nil, nil, err
+	}
+	uploadURL = new(url.URL)
+	*uploadURL = *baseURL
+
+	path := strings.TrimSuffix(baseURL.Path, "/")
+	path = strings.TrimSuffix(path, "/api/v3")
+	baseURL.Path = path + "/api/v3/"
+	uploadURL.Path = path + "/api/uploads/"
+	return baseURL, uploadURL, nil
+}
+
+// newGithubClient creates a GitHub client using base for github.com, or for
+// the GitHub Enterprise instance at enterpriseAddr if not empty,
+// authenticated if a token is given.
+func newGithubClient(base http.RoundTripper, token string, enterpriseAddr string) (*github.Client, error) {
+	base = &etagTransport{base: base}
+	if enterpriseAddr == "" {
+		return github.NewClient(newHTTPClient(base, token, "api.github.com")), nil
+	}
+
+	baseURL, uploadURL, err := enterpriseURLs(enterpriseAddr)
+	if err != nil {
+		return nil, err
+	}
+	client := github.NewClient(newHTTPClient(base, token, baseURL.Host))
+	client.BaseURL = baseURL
+	client.UploadURL = uploadURL
+	return client, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+// fakeLister is a ReleaseLister returning canned pages of releases.
+type fakeLister struct {
+	mu    sync.Mutex
+	pages [][]github.RepositoryRelease
+}
+
+func (l *fakeLister) ListReleases(owner, repo string, opt *github.ListOptions) ([]github.RepositoryRelease, *github.Response, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	res := &github.Response{}
+	if opt.Page < 1 || opt.Page > len(l.pages) {
+		return nil, res, nil
+	}
+	if opt.Page < len(l.pages) {
+		res.NextPage = opt.Page + 1
+	}
+	return l.pages[opt.Page-1], res, nil
+}
+
+// githubRelease converts rel to a release as listed by GitHub.
+func githubRelease(rel Release) github.RepositoryRelease {
+	r := github.RepositoryRelease{
+		ID:         github.Int(rel.id),
+		TagName:    github.String(rel.Tag),
+		ZipballURL: github.String(rel.URL),
+		Prerelease: github.Bool(rel.Prerelease),
+	}
+	for _, a := range rel.Assets {
+		r.Assets = append(r.Assets, github.ReleaseAsset{
+			ID:                 github.Int(a.id),
+			Name:               github.String(a.Name),
+			BrowserDownloadURL: github.String(a.URL),
+		})
+	}
+	return r
+}
+
+func TestRefreshFromGithub(t *testing.T) {
+	repo := newTestRepo(t)
+	old := repo.release(1, "1.0.0", "linux_amd64")
+	old.Assets = append(old.Assets, Asset{id: 199, Name: "installer.exe", URL: repo.server.URL + "/1.0.0/installer.exe"})
+	lister := &fakeLister{pages: [][]github.RepositoryRelease{{
+		githubRelease(repo.release(2, "1.1.0", "linux_amd64")),
+		githubRelease(old),
+		githubRelease(repo.release(3, "1.2.0-beta.1", "linux_amd64")),
+	}}}
+	repo.manager.source = &githubSource{client: lister}
+
+	if err := repo.manager.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest releases first.
+	var tags []string
+	for _, rel := range repo.manager.releases {
+		tags = append(tags, rel.Tag)
+	}
+	if want := []string{"1.2.0-beta.1", "1.1.0", "1.0.0"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("releases = %v, want %v", tags, want)
+	}
+
+	// The installer is not an update.
+	if n := repo.manager.Health().Assets; n != 3 {
+		t.Errorf("%d assets, want 3", n)
+	}
+
+	for channel, want := range map[string]string{stableChannel: "1.1.0", "beta": "1.2.0-beta.1"} {
+		if latest := repo.manager.Latest("linux", "amd64", channel); latest == nil || latest.Version != want {
+			t.Errorf("latest on %s = %+v, want %s", channel, latest, want)
+		}
+	}
+}
+
+func TestGithubSourcePages(t *testing.T) {
+	repo := newTestRepo(t)
+	lister := &fakeLister{pages: [][]github.RepositoryRelease{
+		{githubRelease(repo.release(5, "1.4.0", "linux_amd64")), githubRelease(repo.release(4, "1.3.0", "linux_amd64"))},
+		{githubRelease(repo.release(3, "1.2.0", "linux_amd64")), githubRelease(repo.release(2, "1.1.0", "linux_amd64"))},
+		{githubRelease(repo.release(1, "1.0.0", "linux_amd64"))},
+	}}
+
+	releases, err := (&githubSource{client: lister}).Releases("owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, rel := range releases {
+		tags = append(tags, rel.Tag)
+	}
+	if want := []string{"1.4.0", "1.3.0", "1.2.0", "1.1.0", "1.0.0"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("releases = %v, want %v", tags, want)
+	}
+}
+
+func TestGithubSourceNilFields(t *testing.T) {
+	repo := newTestRepo(t)
+	noZipball := githubRelease(repo.release(3, "1.2.0", "linux_amd64", "windows_amd64", "darwin_amd64", "linux_386"))
+	noZipball.ZipballURL = nil
+	noZipball.Assets[1].Name = nil
+	noZipball.Assets[2].BrowserDownloadURL = nil
+	noZipball.Assets[3].ID = nil
+	noTag := githubRelease(repo.release(2, "1.1.0", "linux_amd64"))
+	noTag.TagName = nil
+	noID := githubRelease(repo.release(1, "1.0.0", "linux_amd64"))
+	noID.ID = nil
+	lister := &fakeLister{pages: [][]github.RepositoryRelease{{noZipball, noTag, noID, {}}}}
+
+	releases, err := (&githubSource{client: lister}).Releases("owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 1 || releases[0].Tag != "1.2.0" {
+		t.Fatalf("releases = %+v, want 1.2.0 only", releases)
+	}
+	if assets := releases[0].Assets; len(assets) != 1 || assets[0].Name != "update_linux_amd64" {
+		t.Errorf("assets = %+v, want update_linux_amd64 only", assets)
+	}
+}
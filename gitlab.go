@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const gitlabPerPage = 100
+
+// gitlabRelease is a release as returned by the GitLab releases API.
+type gitlabRelease struct {
+	TagName     string    `json:"tag_name"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	ReleasedAt  time.Time `json:"released_at"`
+	Assets      struct {
+		Sources []struct {
+			Format string `json:"format"`
+			URL    string `json:"url"`
+		} `json:"sources"`
+		Links []struct {
+			ID             int    `json:"id"`
+			Name           string `json:"name"`
+			URL            string `json:"url"`
+			DirectAssetURL string `json:"direct_asset_url"`
+		} `json:"links"`
+	} `json:"assets"`
+}
+
+// statusError tells a provider answered with an unexpected status.
+type statusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Expecting 200 OK, got: %s", e.Status)
+}
+
+// gitlabSource is a ReleaseSource listing GitLab releases. Update assets are
+// the release links, downloaded from their direct asset URL when there is
+// one.
+type gitlabSource struct {
+	client  *http.Client
+	baseURL *url.URL
+}
+
+// newGitlabSource creates a gitlabSource for the GitLab instance at addr,
+// using base and authenticated if a token is given.
+func newGitlabSource(base http.RoundTripper, token string, addr string) (*gitlabSource, error) {
+	baseURL, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL.Scheme == "" || baseURL.Host == "" {
+		return nil, fmt.Errorf("Expecting an absolute URL, got %q.", addr)
+	}
+	baseURL.Path = strings.TrimSuffix(baseURL.Path, "/") + "/api/v4/"
+
+	client := &http.Client{Transport: base}
+	if token != "" {
+		client.Transport = &tokenTransport{token: token, scheme: "Bearer", host: baseURL.Host, base: base}
+	}
+	return &gitlabSource{client: client, baseURL: baseURL}, nil
+}
+
+// Releases pages through all releases of the owner/repo project.
+func (s *gitlabSource) Releases(owner, repo string) ([]Release, error) {
+	var releases []Release
+
+	page := "1"
+	for page != "" {
+		rels, next, err := s.listReleases(owner+"/"+repo, page)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range rels {
+			version := rels[i].TagName
+			released := rels[i].ReleasedAt
+			if released.IsZero() {
+				released = rels[i].CreatedAt
+			}
+			rel := Release{
+				// GitLab releases have no ID, the release time orders them
+				// the same way.
+				id:        int(released.Unix()),
+				Tag:       version,
+				Rollout:   parseRollout(rels[i].Description),
+				Ramp:      parseRamp(rels[i].Description, released),
+				Mandatory: parseMandatory(rels[i].Description),
+				Published: released,
+				Title:     rels[i].Name,
+				Notes:     rels[i].Description,
+			}
+			for _, source := range rels[i].Assets.Sources {
+				if source.Format == "zip" {
+					rel.URL = source.URL
+				}
+			}
+			rel.Assets = make([]Asset, 0, len(rels[i].Assets.Links))
+			for _, link := range rels[i].Assets.Links {
+				a := Asset{
+					id:   link.ID,
+					Name: link.Name,
+					URL:  link.DirectAssetURL,
+				}
+				if a.URL == "" {
+					a.URL = link.URL
+				}
+				rel.Assets = append(rel.Assets, a)
+			}
+			logger.Info("Found release", "version", version, "assets", len(rel.Assets))
+			releases = append(releases, rel)
+		}
+
+		page = next
+	}
+
+	return releases, nil
+}
+
+// listReleases fetches a page of releases of project. It returns the next
+// page, empty on the last one.
+func (s *gitlabSource) listReleases(project string, page string) (rels []gitlabRelease, next string, err error) {
+	// The project path is a single, escaped, path segment.
+	u := *s.baseURL
+	u.RawPath = s.baseURL.EscapedPath() + "projects/" + url.PathEscape(project) + "/releases"
+	u.Path += "projects/" + project + "/releases"
+	q := url.Values{}
+	q.Set("page", page)
+	q.Set("per_page", fmt.Sprint(gitlabPerPage))
+	u.RawQuery = q.Encode()
+
+	res, err := s.client.Get(u.String())
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", &statusError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(&rels); err != nil {
+		return nil, "", err
+	}
+
+	return rels, res.Header.Get("X-Next-Page"), nil
+}
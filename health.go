@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// healthHandler reports whether the server is ready to answer update checks,
+// that is whether every application was refreshed at least once or has
+// assets, along with the assets that failed to load.
+type healthHandler struct{}
+
+type healthReport struct {
+	Status       string            `json:"status"`
+	FailedAssets int               `json:"failed_assets"`
+	Apps         map[string]Health `json:"apps"`
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{
+		Status: "ok",
+		Apps:   make(map[string]Health),
+	}
+	apps.Each(func(appID string, m *ReleaseManager) {
+		health := m.Health()
+		if health.Assets == 0 && health.LastRefresh.IsZero() {
+			report.Status = "starting"
+		}
+		report.FailedAssets += health.FailedAssets
+		report.Apps[appID] = health
+	})
+
+	content, err := json.Marshal(report)
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}
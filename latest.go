@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+// latestHandler tells the latest version on a channel for a platform, without
+// checking for an update:
+//
+//	GET /latest?os=windows&arch=amd64&channel=beta
+type latestHandler struct{}
+
+func (h *latestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, args.ERROR_METHOD_NOT_ALLOWED, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("os") == "" {
+		writeError(w, http.StatusBadRequest, args.ERROR_MISSING_OS, "OS is required")
+		return
+	}
+	if q.Get("arch") == "" {
+		writeError(w, http.StatusBadRequest, args.ERROR_MISSING_ARCH, "Arch is required")
+		return
+	}
+	channel := q.Get("channel")
+	if channel == "" {
+		channel = stableChannel
+	}
+
+	m, err := apps.Get(q.Get("app"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errorCode(err), err.Error())
+		return
+	}
+
+	latest := m.Latest(q.Get("os"), q.Get("arch"), channel)
+	if latest == nil {
+		writeError(w, http.StatusNotFound, args.ERROR_NO_RELEASE, "No release for this platform and channel")
+		return
+	}
+
+	writeJSON(w, latest)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix starts the listen addresses of Unix sockets.
+const unixPrefix = "unix:"
+
+// listenAddr is an address to accept connections on.
+type listenAddr struct {
+	network string
+	address string
+}
+
+func (a listenAddr) String() string {
+	if a.network == "unix" {
+		return unixPrefix + a.address
+	}
+	return a.address
+}
+
+// parseListenAddrs parses a comma separated list of host:port addresses,
+// IPv6 hosts in brackets, and unix:/path Unix socket addresses.
+func parseListenAddrs(s string) ([]listenAddr, error) {
+	var addrs []listenAddr
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if strings.HasPrefix(entry, unixPrefix) {
+			path := strings.TrimPrefix(entry, unixPrefix)
+			if path == "" {
+				return nil, fmt.Errorf("missing socket path in %q", entry)
+			}
+			addrs = append(addrs, listenAddr{network: "unix", address: path})
+			continue
+		}
+		_, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("expecting host:port or unix:/path, got %q", entry)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid port in %q", entry)
+		}
+		addrs = append(addrs, listenAddr{network: "tcp", address: entry})
+	}
+	return addrs, nil
+}
+
+// listen opens a listener per address, stale Unix sockets are replaced. It
+// closes the ones already opened if one fails.
+func listen(addrs []listenAddr) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		if addr.network == "unix" {
+			if fi, err := os.Stat(addr.address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(addr.address)
+			}
+		}
+		l, err := net.Listen(addr.network, addr.address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
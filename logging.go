@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+)
+
+// logger emits structured log records. It defaults to the legacy text format
+// of the standard logger.
+var logger = slog.Default()
+
+// logWriter writes to the current output of the standard logger, so that log
+// file rotation applies to structured logs too.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	return log.Writer().Write(p)
+}
+
+// setLogFormat switches the structured logger between "text" and "json".
+func setLogFormat(format string) error {
+	switch format {
+	case "text":
+		logger = slog.Default()
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(logWriter{}, nil))
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
@@ -1,124 +1,574 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/blang/semver"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/yinghuocho/autoupdate-server/args"
 	"github.com/yinghuocho/golibfq/utils"
-)
-
-const (
-	githubRefreshTime     = time.Minute * 10
-	localPatchesDirectory = "./patches/"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/net/http2"
 )
 
 var (
 	flagPrivateKey         = flag.String("k", "./private.pem", "Path to private key.")
-	flagLocalAddr          = flag.String("l", "127.0.0.1:6868", "Local bind address.")
-	flagPublicAddr         = flag.String("p", "https://update.gofirefly.org/", "Public address.")
+	flagSigner             = flag.String("signer", "pem", "What signs updates: pem, the -k private key, or command, the -signer-command program.")
+	flagSignerCommand      = flag.String("signer-command", "", "Program signing updates with -signer command, e.g. with a KMS or HSM. It reads a hex encoded SHA256 digest on stdin and writes the hex encoded signature, -pubkey is then required.")
+	flagPublicKey          = flag.String("pubkey", "", "Path to the public key clients verify signatures with, checked against the private key.")
+	flagExtraKeys          = flag.String("extra-keys", "", "Comma-separated paths to more private keys to sign assets with while rotating keys.")
+	flagLocalAddr          = flag.String("l", "127.0.0.1:6868", "Comma-separated local bind addresses, host:port or unix:/path/to/socket.")
+	flagPublicAddr         = flag.String("p", "https://update.gofirefly.org/", "Public address, taken from each request (honoring X-Forwarded-Proto and X-Forwarded-Host with -trust-proxy) if empty or \"auto\".")
 	flagGithubOrganization = flag.String("o", "yinghuocho", "Github organization.")
 	flagGithubProject      = flag.String("n", "firefly-proxy", "Github project name.")
 	flagAssetDir           = flag.String("asset", "./assets/", "asset directory.")
 	flagPatchDir           = flag.String("patch", "./patches/", "patch directory.")
+	flagTmpDir             = flag.String("tmpdir", "", "Directory for intermediate files of patch generation, e.g. on a fast ephemeral volume. The patch directory if empty.")
 	flagPidFile            = flag.String("pid", ".", "pid file")
 	flagLogFile            = flag.String("log", ".", "log file")
+	flagMaxParamsSize      = flag.Int64("max-params-size", 1<<20, "Size in bytes of update check params at most, decompressed, larger ones are refused with 413.")
+	flagStrictParams       = flag.Bool("strict-params", false, "Refuse update check params with unknown fields.")
+	flagDedupeChecks       = flag.Bool("dedupe", true, "Coalesce identical in-flight update checks.")
+	flagSignResponses      = flag.Bool("sign-responses", false, "Sign update responses, the signature is sent in the X-Signature header.")
+	flagRefreshSecret      = flag.String("refresh-secret", "", "Shared secret enabling the /refresh and /admin/ endpoints.")
+	flagCertFile           = flag.String("cert", "", "TLS certificate file, serves HTTPS together with -key.")
+	flagKeyFile            = flag.String("key", "", "TLS private key file, serves HTTPS together with -cert.")
+	flagAdminCA            = flag.String("admin-ca", "", "CA certificates file, admin endpoints then require a client certificate signed by one of them.")
+	flagReadHeaderTimeout  = flag.Duration("read-header-timeout", 10*time.Second, "Time allowed to read request headers, 0 for no limit.")
+	flagReadTimeout        = flag.Duration("read-timeout", 30*time.Second, "Time allowed to read whole requests, 0 for no limit.")
+	flagWriteTimeout       = flag.Duration("write-timeout", 10*time.Minute, "Time allowed to answer requests, patch generation and downloads included, 0 for no limit.")
+	flagIdleTimeout        = flag.Duration("idle-timeout", 2*time.Minute, "Time idle keep-alive connections are kept open, 0 for no limit.")
+	flagHTTP2Streams       = flag.Int("http2-streams", 250, "Maximum number of concurrent requests per HTTP/2 connection.")
+	flagOTLPEndpoint       = flag.String("otlp-endpoint", "", "OTLP/HTTP collector to send traces to, e.g. http://localhost:4318, no tracing if empty.")
+	flagShutdownTimeout    = flag.Duration("shutdown-timeout", 30*time.Second, "Time to wait for in-flight requests on shutdown.")
+	flagRefreshInterval    = flag.Duration("refresh", 10*time.Minute, "Interval between checks for new releases.")
+	flagRefreshJitter      = flag.Float64("refresh-jitter", 0.1, "Fraction of -refresh by which each interval randomly varies, so replicas do not refresh together.")
+	flagStartJitter        = flag.Duration("start-jitter", 0, "Random delay up to this before the first refresh, serving the cached assets meanwhile.")
+	flagGithubToken        = flag.String("token", "", "Github or GitLab API token.")
+	flagUserAgent          = flag.String("user-agent", "", "Text added to the User-Agent of requests to GitHub, GitLab and asset downloads, e.g. a contact address.")
+	flagProxy              = flag.String("proxy", "", "Proxy for outbound requests, HTTP_PROXY and HTTPS_PROXY are used if empty.")
+	flagGithubURL          = flag.String("github-url", "", "Github Enterprise address, github.com is used if empty.")
+	flagProvider           = flag.String("provider", "github", "Where releases are published, github, gitlab or manifest.")
+	flagGitlabURL          = flag.String("gitlab-url", "https://gitlab.com", "GitLab instance address, used with -provider gitlab.")
+	flagManifest           = flag.String("manifest", "", "JSON file listing releases, used with -provider manifest.")
+	flagApps               = flag.String("apps", "", "Additional applications to serve, as comma separated appid=owner/repo.")
+	flagReapInterval       = flag.Duration("reap-interval", time.Hour, "Interval between removals of stale assets and patches, 0 disables it.")
+	flagReapTTL            = flag.Duration("reap-ttl", 7*24*time.Hour, "Age after which unused assets and patches are removed.")
+	flagMaxPatchJobs       = flag.Int("patch-jobs", 1, "Maximum number of patches generated at once.")
+	flagPatchWait          = flag.Bool("patch-wait", true, "Wait for a patch slot instead of offering the full download when all are busy.")
+	flagPatchCacheEntries  = flag.Int("patch-cache-entries", 0, "Patches kept track of at most, least recently used first forgotten, 0 means no limit.")
+	flagPatchCacheBytes    = flag.Int64("patch-cache-bytes", 0, "Total size in bytes of the patches kept track of, 0 means no limit.")
+	flagPatchCacheDelete   = flag.Bool("patch-cache-delete", false, "Remove the files of patches forgotten by the patch cache.")
+	flagRateLimit          = flag.Float64("rate", 0, "Update checks allowed per second and client IP, 0 disables rate limiting.")
+	flagRateBurst          = flag.Int("burst", 10, "Update checks a client IP may send in a burst.")
+	flagTrustProxy         = flag.Bool("trust-proxy", false, "Take client IPs from the last X-Forwarded-For entry, set by the proxy in front of the server.")
+	flagMaxChecksumMisses  = flag.Int("max-checksum-misses", 0, "Update checks with a checksum of no known asset a client IP may send per -checksum-miss-window before being blocked for as long, 0 never blocks. Clients behind a shared NAT count and are blocked together.")
+	flagChecksumMissWindow = flag.Duration("checksum-miss-window", 10*time.Minute, "Window of -max-checksum-misses.")
+	flagMaxPatchRatio      = flag.Float64("max-patch-ratio", 0.8, "Largest size of a patch relative to the update offered, larger patches are replaced with the full download. No limit if 0.")
+	flagFleetWindow        = flag.Duration("fleet-window", 24*time.Hour, "Window over which update checks are counted by client version, os and arch for /admin/fleet. Not counted if 0.")
+	flagNoPatch            = flag.Bool("no-patch", false, "Never generate patches, always offer full downloads. No patch directory is needed.")
+	flagPatcher            = flag.String("patcher", "", "Patch algorithm by OS, e.g. windows=courgette,linux=courgette, for clients listing it in patch_types. bsdiff is used otherwise.")
+	flagPatchChain         = flag.Int("patch-chain", 0, "Most patches offered in a chain through intermediate versions to clients that can apply them, when smaller than the direct patch. Chains are not offered if less than 2.")
+	flagVerifyPatches      = flag.Bool("verify-patches", true, "Check patches reproduce their target before serving them.")
+	flagDownloadTimeout    = flag.Duration("download-timeout", 30*time.Minute, "Time allowed to download an asset, 0 means no limit.")
+	flagMaxAssetSize       = flag.Int64("max-asset-size", 1<<30, "Largest asset in bytes that is downloaded, 0 means no limit.")
+	flagMinAutoVersion     = flag.String("min-auto-version", "", "Clients older than this version are asked to update manually.")
+	flagAssetWorkers       = flag.Int("asset-workers", 4, "Number of assets downloaded and signed at once on refresh.")
+	flagBake               = flag.Duration("bake", 0, "Hold releases back from clients but canaries for this long after they are published.")
+	flagMaxVersion         = flag.String("max-version", "", "Newest version offered to clients that are not canaries, no limit if empty.")
+	flagAllowForceVersion  = flag.Bool("allow-force-version", false, "Offer clients the version of their force_version tag, whatever version they run. For testing only, never enable it in production.")
+	flagUpdatePolicy       = flag.String("update-policy", policyLatest, "Versions offered to clients: latest, or same-major to not cross major versions.")
+	flagCanaryTag          = flag.String("canary-tag", "canary", "Tag that canary clients set to true to be offered versions above -max-version.")
+	flagIncludeDrafts      = flag.Bool("include-drafts", false, "Serve draft releases too, for testing.")
+	flagPrereleaseChannel  = flag.String("prerelease-channel", "prerelease", "Channel of releases marked as pre-releases whose version has no pre-release part.")
+	flagVerify             = flag.String("verify", "", "Sign this file as assets are signed, verify the signature as clients would, print the outcome and exit.")
+	flagDryRun             = flag.Bool("dry-run", false, "Scan releases and report update assets without downloading or signing them, then exit.")
+	flagOnce               = flag.Bool("once", false, "Refresh assets once, then exit without serving.")
+	flagPregenerate        = flag.Bool("pregenerate", false, "Generate the patches from every known version to the latest ones, then exit.")
+	flagNoCache            = flag.Bool("no-cache", false, "Ignore assets cached by a previous run.")
+	flagAssetPrefer        = flag.String("asset-prefer", "", "Comma separated asset name suffixes, most preferred first, to choose between assets of the same platform.")
+	flagStorage            = flag.String("storage", "disk", "Where assets and patches are shared between instances, disk or s3.")
+	flagS3Endpoint         = flag.String("s3-endpoint", "", "S3 endpoint, used with -storage s3.")
+	flagS3Bucket           = flag.String("s3-bucket", "", "S3 bucket, used with -storage s3.")
+	flagS3AccessKey        = flag.String("s3-access-key", "", "S3 access key.")
+	flagS3SecretKey        = flag.String("s3-secret-key", "", "S3 secret key.")
+	flagS3PublicURL        = flag.String("s3-public-url", "", "Public address of the S3 bucket, patch URLs are presigned if empty.")
+	flagTagFormat          = flag.String("tag-format", "semver", "How release tags tell versions: semver, date (e.g. build-20240115, as 20240115.0.0) or regexp.")
+	flagTagPattern         = flag.String("tag-pattern", "", "Regexp finding versions in tags, with (?P<major>...) and optionally (?P<minor>...), (?P<patch>...) and (?P<pre>...) groups, used with -tag-format regexp.")
+	flagExtraOS            = flag.String("extra-os", "", "Comma-separated lowercase operating systems recognized besides windows, linux and darwin, e.g. freebsd,openbsd.")
+	flagAssetPattern       = flag.String("asset-pattern", "", "Regexp recognizing update assets, with (?P<os>...), (?P<arch>...) and optionally (?P<version>...) groups.")
+	flagLogFormat          = flag.String("log-format", "text", "Log format, text or json.")
+	flagConfigFile         = flag.String("config", "", "JSON config file setting the flags listed in the README, YAML is not supported. Command line flags take precedence.")
 	flagHelp               = flag.Bool("h", false, "Shows help.")
 )
 
 var (
-	releaseManager *ReleaseManager
+	apps       *AppRegistry
+	checkGroup flightGroup
+	refreshMu  sync.Mutex
+)
+
+// version, commit and buildDate describe the build of the server, set at
+// build time with e.g. -ldflags "-X main.version=1.2.3 -X main.commit=abc123
+// -X main.buildDate=2024-01-15T10:00:00Z".
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+const (
+	// notReadyRetryAfter is the number of seconds clients are asked to wait
+	// while releases are loaded.
+	notReadyRetryAfter = 30
 )
 
 type updateHandler struct{}
 
+// cancelRefresh cancels the context of the refresh in progress, if any.
+var cancelRefresh struct {
+	sync.Mutex
+	fn context.CancelFunc
+}
+
 // updateAssets checks for new assets released on the github releases page.
-func updateAssets() error {
+// Only one refresh runs at a time, it stops waiting to retry listing releases
+// when ctx is done or interruptRefresh is called.
+func updateAssets(ctx context.Context) (*RefreshSummary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	cancelRefresh.Lock()
+	cancelRefresh.fn = cancel
+	cancelRefresh.Unlock()
+	defer func() {
+		cancelRefresh.Lock()
+		cancelRefresh.fn = nil
+		cancelRefresh.Unlock()
+	}()
+
 	log.Printf("Updating assets...")
-	if err := releaseManager.UpdateAssetsMap(); err != nil {
-		return err
+	return apps.Refresh(ctx)
+}
+
+// interruptRefresh makes the refresh in progress give up waiting to retry,
+// so that whoever waits for it to finish is not held for long.
+func interruptRefresh() {
+	cancelRefresh.Lock()
+	defer cancelRefresh.Unlock()
+	if cancelRefresh.fn != nil {
+		cancelRefresh.fn()
 	}
-	return nil
 }
 
-// backgroundUpdate periodically looks for releases.
-func backgroundUpdate() {
+// backgroundUpdate periodically looks for releases, first after wait. After
+// hitting the GitHub API rate limit it waits for the limit to reset instead.
+func backgroundUpdate(wait time.Duration) {
 	for {
-		time.Sleep(githubRefreshTime)
+		time.Sleep(wait)
+		wait = jitter(settings().refreshInterval, *flagRefreshJitter)
 		// Updating assets...
-		if err := updateAssets(); err != nil {
+		if _, err := updateAssets(context.Background()); err != nil {
 			log.Printf("updateAssets: %s", err)
+			if reset, ok := rateLimitReset(err); ok && time.Until(reset) > 0 {
+				wait = time.Until(reset) + time.Second
+				log.Printf("Rate limited, next update at %s", reset)
+			}
 		}
 	}
 }
 
+// jitter returns d varied randomly by up to fraction of it, either way.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// paramsKey builds a key that identifies an update check by all of its
+// parameters.
+func paramsKey(p *args.Params) string {
+	key := fmt.Sprintf("%s|%d|%s|%s|%s|%s|%s|%s|%s|%s|%s", p.AppId, p.Version, p.AppVersion, p.OS, p.Arch, p.OSVersion, p.ChecksumAlgorithm, p.Checksum, p.FromVersion, p.Channel, p.UserId)
+	if p.WithNotes {
+		key += "|notes"
+	}
+	if p.ChainedPatches {
+		key += "|chained"
+	}
+	if p.MetadataOnly {
+		key += "|metadata"
+	}
+	for _, c := range p.Channels {
+		key += "|channel=" + c
+	}
+	for _, t := range p.PatchTypes {
+		key += "|patch=" + string(t)
+	}
+	tags := make([]string, 0, len(p.Tags))
+	for k, v := range p.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	for _, t := range tags {
+		key += "|" + t
+	}
+	return key
+}
+
+// checkForUpdate calls CheckForUpdate, sharing the result among identical
+// concurrent checks when deduplication is enabled. The returned result is a
+// copy that can be customized per client: URLs are made absolute afterwards,
+// which is why the public address is not part of paramsKey.
+func checkForUpdate(ctx context.Context, p *args.Params) (*args.Result, error) {
+	if !*flagDedupeChecks {
+		return apps.CheckForUpdate(ctx, p)
+	}
+	v, err := checkGroup.Do(ctx, paramsKey(p), func(ctx context.Context) (interface{}, error) {
+		return apps.CheckForUpdate(ctx, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyResult(v.(*args.Result)), nil
+}
+
+// copyResult copies a result shared by coalesced checks, slices and maps
+// included, so that each client can have its URLs made absolute with its own
+// public address.
+func copyResult(shared *args.Result) *args.Result {
+	res := *shared
+	if shared.PatchChain != nil {
+		res.PatchChain = append([]args.ChainedPatch(nil), shared.PatchChain...)
+	}
+	if shared.Signatures != nil {
+		res.Signatures = make(map[string]string, len(shared.Signatures))
+		for k, v := range shared.Signatures {
+			res.Signatures[k] = v
+		}
+	}
+	return &res
+}
+
 func (u *updateHandler) closeWithStatus(w http.ResponseWriter, status int) {
 	w.WriteHeader(status)
 	w.Write([]byte(http.StatusText(status)))
 }
 
+// closeWithError answers with status and a JSON args.Error body.
+func (u *updateHandler) closeWithError(w http.ResponseWriter, status int, code args.ErrorCode, message string) {
+	writeError(w, status, code, message)
+}
+
+// closeWithParamsError answers a request whose params could not be read,
+// with 413 if they are too large.
+func (u *updateHandler) closeWithParamsError(w http.ResponseWriter, prefix string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		u.closeWithError(w, http.StatusRequestEntityTooLarge, args.ERROR_BAD_REQUEST, fmt.Sprintf("Params larger than %d bytes", tooLarge.Limit))
+		return
+	}
+	u.closeWithError(w, http.StatusBadRequest, args.ERROR_BAD_REQUEST, prefix+err.Error())
+}
+
 func (u *updateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var res *args.Result
 
+	noStore(w)
+
 	if r.Method == "POST" {
 		defer r.Body.Close()
 
+		if probes != nil && probes.Blocked(clientIP(r, probes.trustProxy)) {
+			blockedChecksTotal.Inc()
+			writeStatus(w, http.StatusTooManyRequests)
+			return
+		}
+
+		var body io.Reader = http.MaxBytesReader(w, r.Body, *flagMaxParamsSize)
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			zr, err := gzip.NewReader(body)
+			if err != nil {
+				u.closeWithParamsError(w, "Could not decompress params: ", err)
+				return
+			}
+			defer zr.Close()
+			// Don't let a small compressed body inflate without bounds.
+			body = http.MaxBytesReader(w, zr, *flagMaxParamsSize)
+		}
+
+		// Continue the trace of the client, if any.
+		ctx, span := tracer.Start(otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header)), "update")
+		defer span.End()
+
 		var params args.Params
-		decoder := json.NewDecoder(r.Body)
+		decoder := json.NewDecoder(body)
+		if *flagStrictParams {
+			decoder.DisallowUnknownFields()
+		}
 
 		if err = decoder.Decode(&params); err != nil {
-			u.closeWithStatus(w, http.StatusBadRequest)
+			u.closeWithParamsError(w, "Could not decode params: ", err)
 			return
 		}
+		normalizeParams(&params)
+
+		if fleetWindow > 0 {
+			fleet.record(&params)
+		}
+
+		span.SetAttributes(
+			attribute.String("os", params.OS),
+			attribute.String("arch", params.Arch),
+			attribute.String("from_version", params.AppVersion),
+		)
 
-		if res, err = releaseManager.CheckForUpdate(&params); err != nil {
-			log.Printf("CheckForUpdate failed with error: %q", err)
-			if err == ErrNoUpdateAvailable {
+		start := time.Now()
+		res, err = checkForUpdate(ctx, &params)
+		traceResult(span, res, err)
+		if err == ErrNoUpdateAvailable && probes != nil && !apps.knowsCurrent(&params) {
+			probes.Miss(clientIP(r, probes.trustProxy), &params)
+		}
+		if err != nil {
+			logger.Info("CheckForUpdate failed", "os", params.OS, "arch", params.Arch, "from_version", params.AppVersion, "error", err, "duration", time.Since(start))
+			switch err {
+			case ErrNoUpdateAvailable:
+				// Sign the empty body, or "no update" could be forged.
+				if *flagSignResponses {
+					if err = signResponse(w, params.AppId, []byte{}); err != nil {
+						log.Printf("Could not sign response: %q", err)
+						u.closeWithError(w, http.StatusInternalServerError, args.ERROR_INTERNAL, http.StatusText(http.StatusInternalServerError))
+						return
+					}
+				}
 				u.closeWithStatus(w, http.StatusNoContent)
 				return
+			case ErrNotReady:
+				w.Header().Set("Retry-After", strconv.Itoa(notReadyRetryAfter))
+				u.closeWithError(w, http.StatusServiceUnavailable, errorCode(err), err.Error())
+				return
+			case ErrUnsupportedPlatform:
+				u.closeWithError(w, http.StatusNotFound, errorCode(err), err.Error())
+				return
 			}
-			u.closeWithStatus(w, http.StatusExpectationFailed)
+			u.closeWithError(w, http.StatusExpectationFailed, errorCode(err), err.Error())
 			return
 		}
 
-		if res.PatchURL != "" {
-			res.PatchURL = *flagPublicAddr + res.PatchURL
+		res.PatchURL = absoluteURL(r, res.PatchURL)
+		for i := range res.PatchChain {
+			res.PatchChain[i].PatchURL = absoluteURL(r, res.PatchChain[i].PatchURL)
 		}
 
+		logger.Info("Offering update", "os", params.OS, "arch", params.Arch, "from_version", params.AppVersion, "to_version", res.Version, "patch_type", res.PatchType, "duration", time.Since(start))
+
 		var content []byte
 
+		// json.Marshal writes struct fields in order and map keys sorted, the
+		// same result always makes the same body.
 		if content, err = json.Marshal(res); err != nil {
-			u.closeWithStatus(w, http.StatusInternalServerError)
+			u.closeWithError(w, http.StatusInternalServerError, args.ERROR_INTERNAL, http.StatusText(http.StatusInternalServerError))
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		if *flagSignResponses {
+			if err = signResponse(w, params.AppId, content); err != nil {
+				log.Printf("Could not sign response: %q", err)
+				u.closeWithError(w, http.StatusInternalServerError, args.ERROR_INTERNAL, http.StatusText(http.StatusInternalServerError))
+				return
+			}
+		}
+
+		if acceptsGzip(r) {
+			if content, err = gzipBytes(content); err != nil {
+				u.closeWithError(w, http.StatusInternalServerError, args.ERROR_INTERNAL, http.StatusText(http.StatusInternalServerError))
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
 		w.Write(content)
 		return
 	}
-	u.closeWithStatus(w, http.StatusNotFound)
+	w.Header().Set("Allow", "POST")
+	u.closeWithError(w, http.StatusMethodNotAllowed, args.ERROR_METHOD_NOT_ALLOWED, http.StatusText(http.StatusMethodNotAllowed))
 	return
 }
 
-func loadPrivateKey(filename string) (*rsa.PrivateKey, error) {
+// signResponse sets the X-Signature header to the signature of body by the
+// signing key of the app, and X-Signature-Key to the ID of the key.
+func signResponse(w http.ResponseWriter, appID string, body []byte) error {
+	m, err := apps.Get(appID)
+	if err != nil {
+		return err
+	}
+	signature, keyID, err := m.SignResponse(body)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("X-Signature", signature)
+	w.Header().Set("X-Signature-Key", keyID)
+	return nil
+}
+
+// noStore keeps proxies from caching update check responses, a stale "no
+// update" would strand clients on an old version. Patches, which never change,
+// are cached by the patches handler.
+func noStore(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	// For HTTP/1.0 caches.
+	h.Set("Pragma", "no-cache")
+	vary := "Accept-Encoding"
+	if addr := settings().publicAddr; (addr == "" || addr == autoPublicAddr) && *flagTrustProxy {
+		// Patch URLs are built from these.
+		vary += ", X-Forwarded-Proto, X-Forwarded-Host"
+	}
+	h.Set("Vary", vary)
+}
+
+// acceptsGzip tells whether the client accepts gzip compressed responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if !strings.EqualFold(strings.TrimSpace(parts[0]), "gzip") {
+			continue
+		}
+		for _, param := range parts[1:] {
+			// gzip;q=0 means not acceptable.
+			param = strings.TrimSpace(param)
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); strings.HasPrefix(param, "q=") && err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// autoPublicAddr is the -p value asking for the public address to be taken
+// from each request.
+const autoPublicAddr = "auto"
+
+// publicAddr tells the address clients reach the server at: the one given
+// with -p, or else the one the request was sent to, as told by the proxy in
+// front of the server with -trust-proxy. Other clients could pick the host of
+// the patch URLs they are given.
+func publicAddr(r *http.Request) string {
+	if addr := settings().publicAddr; addr != "" && addr != autoPublicAddr {
+		return addr
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if *flagTrustProxy {
+		if proto := lastHeaderValue(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if h := lastHeaderValue(r, "X-Forwarded-Host"); h != "" {
+			host = h
+		}
+	}
+
+	return scheme + "://" + host + "/"
+}
+
+// lastHeaderValue returns the last of the comma-separated values of a header,
+// as set by the proxy in front of the server.
+func lastHeaderValue(r *http.Request, name string) string {
+	values := r.Header.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	parts := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(parts[len(parts)-1])
+}
+
+// absoluteURL makes a URL relative to the public address absolute.
+func absoluteURL(r *http.Request, s string) string {
+	if u, err := url.Parse(s); err == nil && s != "" && !u.IsAbs() {
+		return joinURL(publicAddr(r), s)
+	}
+	return s
+}
+
+// joinURL joins base and a relative path with exactly one slash.
+func joinURL(base string, p string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(p, "/")
+}
+
+func gzipBytes(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadPrivateKey loads an RSA private key, or an RSA or Ed25519 one in PKCS
+// #8 form.
+func loadPrivateKey(filename string) (crypto.Signer, error) {
 	data, e := ioutil.ReadFile(filename)
 	block, _ := pem.Decode(data)
 	if block == nil {
 		return nil, errors.New("couldn't decode PEM file")
 	}
+	if block.Type == "PRIVATE KEY" {
+		key, e := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if e != nil {
+			return nil, e
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("not a signing key")
+		}
+		return signer, nil
+	}
 	privKey, e := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if e != nil {
 		return nil, e
@@ -126,28 +576,212 @@ func loadPrivateKey(filename string) (*rsa.PrivateKey, error) {
 	return privKey, nil
 }
 
+// loadPublicKey loads an RSA or Ed25519 public key.
+func loadPublicKey(filename string) (crypto.PublicKey, error) {
+	data, e := ioutil.ReadFile(filename)
+	if e != nil {
+		return nil, e
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("couldn't decode PEM file")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	pub, e := x509.ParsePKIXPublicKey(block.Bytes)
+	if e != nil {
+		return nil, e
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return pub, nil
+	}
+	return nil, errors.New("not an RSA or Ed25519 public key")
+}
+
+// loadSigningKeys creates the signer given with -signer, checked against the
+// public key given with -pubkey if any, followed by the private keys given
+// with -extra-keys.
+func loadSigningKeys() ([]crypto.Signer, error) {
+	signer, e := newSigner(*flagSigner)
+	if e != nil {
+		return nil, fmt.Errorf("fail to create signer: %s", e)
+	}
+	var pubKey crypto.PublicKey
+	if *flagPublicKey != "" {
+		if pubKey, e = loadPublicKey(*flagPublicKey); e != nil {
+			return nil, fmt.Errorf("fail to load public key: %s", e)
+		}
+	}
+	if e = checkSigningKey(signer, pubKey); e != nil {
+		return nil, fmt.Errorf("signer self-test failed: %s", e)
+	}
+
+	signers := []crypto.Signer{signer}
+	for _, filename := range strings.Split(*flagExtraKeys, ",") {
+		if filename = strings.TrimSpace(filename); filename == "" {
+			continue
+		}
+		extraKey, e := loadPrivateKey(filename)
+		if e != nil {
+			return nil, fmt.Errorf("fail to load private key %s: %s", filename, e)
+		}
+		if e = checkSigningKey(extraKey, nil); e != nil {
+			return nil, fmt.Errorf("private key %s self-test failed: %s", filename, e)
+		}
+		signers = append(signers, extraKey)
+	}
+	return signers, nil
+}
+
 func main() {
 	flag.Parse()
+	if *flagConfigFile != "" {
+		config, err := loadConfig(*flagConfigFile)
+		if err != nil {
+			log.Fatalf("fail to load config file %s: %s", *flagConfigFile, err)
+		}
+		if err = applyConfig(config); err != nil {
+			log.Fatalf("fail to apply config file %s: %s", *flagConfigFile, err)
+		}
+	}
 	if *flagHelp || *flagPrivateKey == "" {
 		flag.Usage()
 		os.Exit(0)
 	}
-	privKey, e := loadPrivateKey(*flagPrivateKey)
+	if err := setLogFormat(*flagLogFormat); err != nil {
+		log.Fatalf("invalid -log-format: %s", err)
+	}
+	if *flagVerify != "" {
+		signer, err := newSigner(*flagSigner)
+		if err != nil {
+			log.Fatalf("fail to create signer: %s", err)
+		}
+		var pubKey crypto.PublicKey
+		if *flagPublicKey != "" {
+			if pubKey, err = loadPublicKey(*flagPublicKey); err != nil {
+				log.Fatalf("fail to load public key: %s", err)
+			}
+		}
+		if err = verifyFile(os.Stdout, *flagVerify, signer, pubKey); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if (*flagCertFile == "") != (*flagKeyFile == "") {
+		log.Fatalf("both -cert and -key are required to serve HTTPS")
+	}
+	listenAddrs, e := parseListenAddrs(*flagLocalAddr)
 	if e != nil {
-		log.Fatalf("fail to load private key: %s", e)
+		log.Fatalf("invalid -l: %s", e)
+	}
+	if *flagAdminCA != "" && *flagCertFile == "" {
+		log.Fatalf("-admin-ca needs -cert and -key to serve HTTPS")
+	}
+	if *flagMaxPatchJobs < 1 {
+		log.Fatalf("-patch-jobs must be at least 1")
+	}
+	if *flagPatchCacheEntries < 0 || *flagPatchCacheBytes < 0 {
+		log.Fatalf("-patch-cache-entries and -patch-cache-bytes must not be negative")
+	}
+	setPatchCacheLimits(*flagPatchCacheEntries, *flagPatchCacheBytes, *flagPatchCacheDelete)
+	// Pregenerating waits for slots rather than skipping patches.
+	setMaxPatchJobs(*flagMaxPatchJobs, *flagPatchWait || *flagPregenerate)
+	verifyPatches = *flagVerifyPatches
+	maxPatchChain = *flagPatchChain
+	maxPatchRatio = *flagMaxPatchRatio
+	if fleetWindow = *flagFleetWindow; fleetWindow > 0 {
+		fleet.setWindow(fleetWindow)
+	}
+	if e = setPatchers(*flagPatcher); e != nil {
+		log.Fatalf("invalid -patcher: %s", e)
+	}
+	downloadTimeout = *flagDownloadTimeout
+	maxAssetSize = *flagMaxAssetSize
+	if *flagExtraOS != "" {
+		if err := addOSes(*flagExtraOS); err != nil {
+			log.Fatalf("invalid -extra-os: %s", err)
+		}
+	}
+	if *flagAssetPattern != "" {
+		if err := setAssetPattern(*flagAssetPattern); err != nil {
+			log.Fatalf("invalid -asset-pattern: %s", err)
+		}
+	}
+	extraApps, e := parseApps(*flagApps)
+	if e != nil {
+		log.Fatalf("invalid -apps: %s", e)
+	}
+	if *flagMinAutoVersion != "" {
+		if minAutoVersion, e = semver.Parse(*flagMinAutoVersion); e != nil {
+			log.Fatalf("invalid -min-auto-version: %s", e)
+		}
+	}
+	if tagParser, e = newTagParser(*flagTagFormat, *flagTagPattern); e != nil {
+		log.Fatal(e)
+	}
+	if *flagMaxVersion != "" {
+		if maxVersion, e = tagParser.ParseTag(*flagMaxVersion); e != nil {
+			log.Fatalf("invalid -max-version: %s", e)
+		}
+	}
+	if *flagMaxParamsSize <= 0 {
+		log.Fatalf("-max-params-size must be positive")
+	}
+	if *flagBake < 0 {
+		log.Fatalf("-bake must not be negative")
+	}
+	bakePeriod = *flagBake
+	if *flagAssetPrefer != "" {
+		assetPreference = strings.Split(*flagAssetPrefer, ",")
+	}
+	switch *flagUpdatePolicy {
+	case policyLatest, policySameMajor:
+		updatePolicy = *flagUpdatePolicy
+	default:
+		log.Fatalf("unknown -update-policy %q, expecting %s or %s", *flagUpdatePolicy, policyLatest, policySameMajor)
 	}
+	assetWorkers = *flagAssetWorkers
+	allowForceVersion = *flagAllowForceVersion
+	if allowForceVersion {
+		log.Printf("WARNING: clients can ask for any version with the %q tag, do not use -allow-force-version in production", forceVersionTag)
+	}
+	canaryTag = *flagCanaryTag
+	includeDrafts = *flagIncludeDrafts
+	prereleaseChannel = *flagPrereleaseChannel
+	*flagAssetDir = dirPath(*flagAssetDir)
+	*flagPatchDir = dirPath(*flagPatchDir)
+	dryRun = *flagDryRun
+	var signers []crypto.Signer
+	if !dryRun {
+		if signers, e = loadSigningKeys(); e != nil {
+			log.Fatal(e)
+		}
+	}
+	applySettings()
 	if !dirExists(*flagAssetDir) {
 		e = os.MkdirAll(*flagAssetDir, 0755)
 		if e != nil {
 			log.Fatalf("fail to create asset dir: %s", e)
 		}
 	}
-	if !dirExists(*flagPatchDir) {
+	noPatches = *flagNoPatch
+	if noPatches && *flagPregenerate {
+		log.Fatalf("-pregenerate cannot be used with -no-patch")
+	}
+	if !noPatches && !dirExists(*flagPatchDir) {
 		e = os.MkdirAll(*flagPatchDir, 0755)
 		if e != nil {
 			log.Fatalf("fail to create patch dir: %s", e)
 		}
 	}
+	if *flagTmpDir != "" && !noPatches {
+		if e = checkWritable(*flagTmpDir); e != nil {
+			log.Fatalf("invalid -tmpdir: %s", e)
+		}
+		patchTmpDir = *flagTmpDir
+	}
 
 	// initiate log file
 	logFile := utils.RotateLog(*flagLogFile, nil)
@@ -160,29 +794,221 @@ func main() {
 
 	// Creating release manager.
 	log.Printf("Starting release manager.")
-	releaseManager = NewReleaseManager(*flagGithubOrganization, *flagGithubProject, *flagAssetDir, *flagPatchDir, privKey)
-	updateAssets()
+	transport, e := newTransport(*flagProxy)
+	if e != nil {
+		log.Fatalf("invalid -proxy: %s", e)
+	}
+	switch *flagStorage {
+	case "disk":
+		assetStorage = &diskStorage{dir: *flagAssetDir}
+		patchStorage = &diskStorage{dir: *flagPatchDir}
+	case "s3":
+		if *flagS3Endpoint == "" || *flagS3Bucket == "" {
+			log.Fatalf("-storage s3 needs -s3-endpoint and -s3-bucket")
+		}
+		if assetStorage, e = newS3Storage(transport, *flagS3Endpoint, *flagS3Bucket, *flagS3AccessKey, *flagS3SecretKey, "assets/", *flagS3PublicURL); e != nil {
+			log.Fatalf("invalid -s3-endpoint: %s", e)
+		}
+		if patchStorage, e = newS3Storage(transport, *flagS3Endpoint, *flagS3Bucket, *flagS3AccessKey, *flagS3SecretKey, "patches/", *flagS3PublicURL); e != nil {
+			log.Fatalf("invalid -s3-endpoint: %s", e)
+		}
+	default:
+		log.Fatalf("unknown -storage %q, expecting disk or s3", *flagStorage)
+	}
+	if !noPatches && !dryRun {
+		if e = checkServed(patchStorage, *flagPatchDir); e != nil {
+			log.Fatalf("patches would not be served: %s", e)
+		}
+	}
+	// Release listings and downloads tell who makes them.
+	transport = &userAgentTransport{agent: userAgent(*flagUserAgent), base: transport}
+	var source ReleaseSource
+	switch *flagProvider {
+	case "github":
+		githubClient, e := newGithubClient(transport, *flagGithubToken, *flagGithubURL)
+		if e != nil {
+			log.Fatalf("invalid -github-url: %s", e)
+		}
+		if *flagGithubURL != "" {
+			// Enterprise assets are downloaded from the instance itself.
+			downloadClient = newHTTPClient(transport, *flagGithubToken, githubClient.BaseURL.Host)
+		} else {
+			downloadClient = newHTTPClient(transport, "", "")
+		}
+		source = &githubSource{client: githubClient.Repositories}
+	case "gitlab":
+		gitlab, e := newGitlabSource(transport, *flagGithubToken, *flagGitlabURL)
+		if e != nil {
+			log.Fatalf("invalid -gitlab-url: %s", e)
+		}
+		// Release links may point to the instance's uploads.
+		downloadClient = gitlab.client
+		source = gitlab
+	case "manifest":
+		if *flagManifest == "" {
+			log.Fatalf("-provider manifest needs -manifest")
+		}
+		downloadClient = newManifestClient(transport)
+		source = &manifestSource{file: *flagManifest}
+	default:
+		log.Fatalf("unknown -provider %q, expecting github, gitlab or manifest", *flagProvider)
+	}
+	apps = NewAppRegistry()
+	apps.Register(*flagGithubProject, NewReleaseManager(source, *flagGithubOrganization, *flagGithubProject, *flagAssetDir, *flagPatchDir, signers...))
+	for appID, repo := range extraApps {
+		apps.Register(appID, NewReleaseManager(source, repo[0], repo[1], *flagAssetDir, *flagPatchDir, signers...))
+	}
+
+	if dryRun {
+		summary, err := updateAssets(context.Background())
+		if err != nil {
+			log.Fatalf("dry run failed: %s", err)
+		}
+		log.Printf("Dry run found %d releases and %d update assets.", summary.Releases, summary.Assets)
+		return
+	}
+
+	if !*flagNoCache {
+		apps.Each(func(appID string, m *ReleaseManager) {
+			if err := m.LoadCache(); err != nil {
+				log.Printf("Could not load asset cache of app %q: %s", appID, err)
+			}
+		})
+	}
+
+	if *flagOnce {
+		summary, err := updateAssets(context.Background())
+		if err != nil {
+			log.Fatalf("refresh failed: %s", err)
+		}
+		log.Printf("Refreshed %d releases, %d update assets, %d failed.", summary.Releases, summary.Assets, summary.Failed)
+		if summary.Failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *flagPregenerate {
+		if _, err := updateAssets(context.Background()); err != nil {
+			log.Fatalf("pregenerate failed: %s", err)
+		}
+		n, err := apps.Pregenerate(context.Background())
+		log.Printf("Pregenerated %d patches.", n)
+		if err != nil {
+			log.Fatalf("pregenerate failed: %s", err)
+		}
+		return
+	}
+
+	// The first refresh is made before serving, unless staggered.
+	firstRefresh := jitter(settings().refreshInterval, *flagRefreshJitter)
+	if *flagStartJitter > 0 {
+		firstRefresh = time.Duration(rand.Int63n(int64(*flagStartJitter)))
+		log.Printf("First refresh in %s.", firstRefresh)
+	} else {
+		updateAssets(context.Background())
+	}
+
+	shutdownTracing, e := setupTracing(context.Background(), *flagOTLPEndpoint)
+	if e != nil {
+		log.Fatalf("invalid -otlp-endpoint: %s", e)
+	}
 
 	// Setting a goroutine for pulling updates periodically
-	go backgroundUpdate()
+	go backgroundUpdate(firstRefresh)
+
+	// Setting a goroutine for removing stale files periodically
+	if *flagReapInterval > 0 {
+		go backgroundReap(*flagReapInterval, *flagReapTTL)
+	}
+
+	if *flagMaxChecksumMisses > 0 {
+		probes = newProbeGuard(*flagMaxChecksumMisses, *flagChecksumMissWindow, *flagTrustProxy)
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/update", new(updateHandler))
-	mux.Handle("/patches/", http.StripPrefix("/patches/", http.FileServer(http.Dir(localPatchesDirectory))))
+	var update http.Handler = new(updateHandler)
+	if *flagRateLimit > 0 {
+		update = &rateLimitHandler{
+			limiter:    newRateLimiter(*flagRateLimit, *flagRateBurst),
+			trustProxy: *flagTrustProxy,
+			next:       update,
+		}
+	}
+	mux.Handle("/update", update)
+	// Admin endpoints need a client certificate with -admin-ca, on top of the
+	// shared secret if any.
+	admin := func(h http.Handler) http.Handler {
+		if *flagAdminCA == "" {
+			return h
+		}
+		return &clientCertHandler{next: h}
+	}
+	if *flagRefreshSecret != "" || *flagAdminCA != "" {
+		mux.Handle("/refresh", admin(new(refreshHandler)))
+		mux.Handle("/admin/assets", admin(new(assetsHandler)))
+		mux.Handle("/admin/fleet", admin(new(fleetHandler)))
+	}
+	mux.Handle("/versions", new(versionsHandler))
+	mux.Handle("/latest", new(latestHandler))
+	mux.Handle("/platforms", new(platformsHandler))
+	mux.Handle("/healthz", new(healthHandler))
+	mux.Handle("/version", new(versionHandler))
+	mux.Handle("/metrics", admin(promhttp.Handler()))
+	if !noPatches {
+		mux.Handle("/patches/", http.StripPrefix("/patches/", newPatchesHandler(patchStorage, *flagPatchDir)))
+	}
 
 	srv := http.Server{
-		Addr:    *flagLocalAddr,
-		Handler: mux,
+		Handler:           mux,
+		ReadHeaderTimeout: *flagReadHeaderTimeout,
+		ReadTimeout:       *flagReadTimeout,
+		WriteTimeout:      *flagWriteTimeout,
+		IdleTimeout:       *flagIdleTimeout,
+	}
+	if *flagAdminCA != "" {
+		if srv.TLSConfig, e = adminTLSConfig(*flagAdminCA); e != nil {
+			log.Fatalf("invalid -admin-ca: %s", e)
+		}
+	}
+
+	listeners, e := listen(listenAddrs)
+	if e != nil {
+		log.Fatalf("fail to listen: %s", e)
 	}
 
-	log.Printf("Starting up HTTP server at %s.", *flagLocalAddr)
-	quit := make(chan bool)
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Printf("ListenAndServe: ", err)
-			close(quit)
+	tls := *flagCertFile != "" && *flagKeyFile != ""
+	if tls {
+		// Clients checking for updates make many small requests, HTTP/2
+		// saves them new connections.
+		if e = http2.ConfigureServer(&srv, &http2.Server{
+			MaxConcurrentStreams: uint32(*flagHTTP2Streams),
+			IdleTimeout:          *flagIdleTimeout,
+		}); e != nil {
+			log.Fatalf("fail to configure HTTP/2: %s", e)
 		}
-	}()
+	}
+	// Any listener failing stops the server.
+	quit := make(chan bool, len(listeners))
+	for i, l := range listeners {
+		if tls {
+			log.Printf("Starting up HTTPS server at %s.", listenAddrs[i])
+		} else {
+			log.Printf("Starting up HTTP server at %s.", listenAddrs[i])
+		}
+		go func(l net.Listener) {
+			var err error
+			if tls {
+				err = srv.ServeTLS(l, *flagCertFile, *flagKeyFile)
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Printf("Serve: %v", err)
+				quit <- true
+			}
+		}(l)
+	}
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch,
@@ -198,6 +1024,7 @@ func main() {
 			switch s {
 			case syscall.SIGHUP:
 				utils.RotateLog(*flagLogFile, logFile)
+				reload()
 			case syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT:
 				log.Printf("Got signal \"%s\", exiting...", s)
 				running = false
@@ -206,5 +1033,15 @@ func main() {
 			running = false
 		}
 	}
+
+	// Let in-flight requests complete before exiting.
+	ctx, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %s", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Could not flush traces: %s", err)
+	}
 	log.Printf("done")
 }
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+// fakeSource is a ReleaseSource returning canned releases.
+type fakeSource struct {
+	mu       sync.Mutex
+	releases []Release
+}
+
+func (s *fakeSource) Releases(owner, repo string) ([]Release, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Callers may reorder the releases.
+	return append([]Release(nil), s.releases...), nil
+}
+
+func (s *fakeSource) set(releases ...Release) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releases = releases
+}
+
+// refPatcher makes patches that merely name the new file, so that tests run
+// without bsdiff. They are much smaller than the test binaries.
+type refPatcher struct{}
+
+func (refPatcher) Type() args.PatchType {
+	return args.PATCHTYPE_BSDIFF
+}
+
+func (refPatcher) Diff(ctx context.Context, oldfile string, newfile string, patchfile string) error {
+	return ioutil.WriteFile(patchfile, []byte(newfile), 0644)
+}
+
+func (refPatcher) Apply(oldfile string, newfile string, patchfile string) error {
+	name, err := ioutil.ReadFile(patchfile)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(string(name))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(newfile, b, 0644)
+}
+
+// testBinary returns the contents of the binary of version for a platform.
+func testBinary(platform string, version string) []byte {
+	return []byte(strings.Repeat(platform+" "+version+"\n", 64))
+}
+
+// testChecksum returns the SHA-256 checksum of b, as sent by clients.
+func testChecksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// testRepo is a repository of releases whose assets are served by an HTTP
+// server, managed by a ReleaseManager registered as the default app.
+type testRepo struct {
+	source  *fakeSource
+	server  *httptest.Server
+	manager *ReleaseManager
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// newTestRepo creates a repository and makes it the only app, with patches
+// made by refPatcher. Globals are restored when the test ends.
+func newTestRepo(t *testing.T) *testRepo {
+	r := &testRepo{
+		source: new(fakeSource),
+		files:  make(map[string][]byte),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		b, ok := r.files[req.URL.Path]
+		r.mu.Unlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(b)
+	}))
+	t.Cleanup(r.server.Close)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assetDir := t.TempDir() + "/"
+	patchDir := t.TempDir() + "/"
+	r.manager = NewReleaseManager(r.source, "owner", "repo", assetDir, patchDir, key)
+
+	savedApps, savedAssetStorage, savedPatchStorage, savedPatcher := apps, assetStorage, patchStorage, defaultPatcher
+	t.Cleanup(func() {
+		apps, assetStorage, patchStorage, defaultPatcher = savedApps, savedAssetStorage, savedPatchStorage, savedPatcher
+	})
+	apps = NewAppRegistry()
+	apps.Register("app", r.manager)
+	assetStorage = &diskStorage{dir: assetDir}
+	patchStorage = &diskStorage{dir: patchDir}
+	defaultPatcher = refPatcher{}
+
+	return r
+}
+
+// release builds a release of the given tag with an update asset for each
+// platform, such as "linux_amd64", and serves the assets.
+func (r *testRepo) release(id int, tag string, platforms ...string) Release {
+	rel := Release{id: id, Tag: tag, Rollout: fullRollout}
+	for _, platform := range platforms {
+		name := "update_" + platform
+		urlPath := "/" + tag + "/" + name
+		r.mu.Lock()
+		r.files[urlPath] = testBinary(platform, tag)
+		r.mu.Unlock()
+		rel.Assets = append(rel.Assets, Asset{id: id*100 + len(rel.Assets), Name: name, URL: r.server.URL + urlPath})
+	}
+	return rel
+}
+
+// publish makes releases the ones listed and refreshes the assets.
+func (r *testRepo) publish(t *testing.T, releases ...Release) {
+	r.source.set(releases...)
+	if _, err := r.manager.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+}
+
+// postUpdate sends params to the /update endpoint of srv.
+func postUpdate(t *testing.T, srv *httptest.Server, params interface{}) *http.Response {
+	body, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(srv.URL+"/update", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// newUpdateServer serves the /update endpoint.
+func newUpdateServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/update", new(updateHandler))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestUpdateHandler(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.publish(t,
+		repo.release(2, "1.1.0", "linux_amd64"),
+		repo.release(1, "1.0.0", "linux_amd64"),
+	)
+	srv := newUpdateServer(t)
+
+	current := testChecksum(testBinary("linux_amd64", "1.0.0"))
+	latest := testChecksum(testBinary("linux_amd64", "1.1.0"))
+
+	tests := []struct {
+		name      string
+		params    args.Params
+		status    int
+		patchType args.PatchType
+		code      args.ErrorCode
+	}{
+		{
+			name:      "patch",
+			params:    args.Params{AppVersion: "1.0.0", OS: "linux", Arch: "amd64", Checksum: current},
+			status:    http.StatusOK,
+			patchType: args.PATCHTYPE_BSDIFF,
+		},
+		{
+			name:      "full download",
+			params:    args.Params{AppVersion: "1.0.0", OS: "linux", Arch: "amd64", Checksum: current, PatchTypes: []args.PatchType{args.PATCHTYPE_COURGETTE}},
+			status:    http.StatusOK,
+			patchType: args.PATCHTYPE_NONE,
+		},
+		{
+			name:   "no update",
+			params: args.Params{AppVersion: "1.1.0", OS: "linux", Arch: "amd64", Checksum: latest},
+			status: http.StatusNoContent,
+		},
+		{
+			name:   "bad version",
+			params: args.Params{AppVersion: "one", OS: "linux", Arch: "amd64", Checksum: current},
+			status: http.StatusExpectationFailed,
+			code:   args.ERROR_BAD_VERSION,
+		},
+		{
+			name:   "missing checksum",
+			params: args.Params{AppVersion: "1.0.0", OS: "linux", Arch: "amd64"},
+			status: http.StatusExpectationFailed,
+			code:   args.ERROR_MISSING_CHECKSUM,
+		},
+		{
+			name:   "missing os",
+			params: args.Params{AppVersion: "1.0.0", Arch: "amd64", Checksum: current},
+			status: http.StatusExpectationFailed,
+			code:   args.ERROR_MISSING_OS,
+		},
+		{
+			name:   "missing arch",
+			params: args.Params{AppVersion: "1.0.0", OS: "linux", Checksum: current},
+			status: http.StatusExpectationFailed,
+			code:   args.ERROR_MISSING_ARCH,
+		},
+		{
+			name:   "unknown os",
+			params: args.Params{AppVersion: "1.0.0", OS: "plan9", Arch: "amd64", Checksum: current},
+			status: http.StatusExpectationFailed,
+			code:   args.ERROR_BAD_OS,
+		},
+		{
+			name:   "unsupported platform",
+			params: args.Params{AppVersion: "1.0.0", OS: "darwin", Arch: "arm64", Checksum: current},
+			status: http.StatusNotFound,
+			code:   args.ERROR_UNSUPPORTED_PLATFORM,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := postUpdate(t, srv, tt.params)
+			if res.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", res.StatusCode, tt.status)
+			}
+
+			switch {
+			case tt.status == http.StatusOK:
+				var r args.Result
+				if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+					t.Fatal(err)
+				}
+				if r.Version != "1.1.0" || r.Checksum != latest || r.Signature == "" {
+					t.Errorf("offered %s with checksum %q and signature %q, want 1.1.0 with %q, signed", r.Version, r.Checksum, r.Signature, latest)
+				}
+				if r.PatchType != tt.patchType {
+					t.Errorf("patch type = %q, want %q", r.PatchType, tt.patchType)
+				}
+				if r.URL != repo.server.URL+"/1.1.0/update_linux_amd64" {
+					t.Errorf("URL = %q", r.URL)
+				}
+				if tt.patchType == args.PATCHTYPE_NONE && r.PatchURL != "" {
+					t.Errorf("patch URL = %q for a full download", r.PatchURL)
+				}
+				if tt.patchType != args.PATCHTYPE_NONE && !strings.HasPrefix(r.PatchURL, srv.URL+"/patches/") {
+					t.Errorf("patch URL = %q, want it under %s/patches/", r.PatchURL, srv.URL)
+				}
+			case tt.code != "":
+				var e args.Error
+				if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+					t.Fatal(err)
+				}
+				if e.Code != tt.code {
+					t.Errorf("error code = %q (%s), want %q", e.Code, e.Message, tt.code)
+				}
+			}
+		})
+	}
+}
+
+// gatePatcher is a refPatcher whose diffs wait for release to be closed.
+type gatePatcher struct {
+	refPatcher
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (p *gatePatcher) Diff(ctx context.Context, oldfile string, newfile string, patchfile string) error {
+	p.entered <- struct{}{}
+	<-p.release
+	return p.refPatcher.Diff(ctx, oldfile, newfile, patchfile)
+}
+
+// flightWaiters returns the number of callers waiting for g, by key.
+func flightWaiters(g *flightGroup) map[string]int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	waiters := make(map[string]int)
+	for key, c := range g.m {
+		waiters[key] = c.waiters
+	}
+	return waiters
+}
+
+// waitFor waits for cond to hold, failing the test after a while.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCheckForUpdateCoalesces(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.publish(t,
+		repo.release(2, "1.1.0", "linux_amd64"),
+		repo.release(1, "1.0.0", "linux_amd64"),
+	)
+	gate := &gatePatcher{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	defaultPatcher = gate
+
+	const n = 8
+	p := args.Params{AppVersion: "1.0.0", OS: "linux", Arch: "amd64", Checksum: testChecksum(testBinary("linux_amd64", "1.0.0"))}
+	key := paramsKey(&p)
+
+	results := make(chan *args.Result, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			q := p
+			res, err := checkForUpdate(context.Background(), &q)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- res
+		}()
+	}
+
+	// All checks wait for a single one, itself waiting for a single patch.
+	<-gate.entered
+	waitFor(t, func() bool { return flightWaiters(&checkGroup)[key] == n })
+	if patches := flightWaiters(&patchGroup); len(patches) != 1 {
+		t.Errorf("%d patches generated, want 1", len(patches))
+	} else {
+		for _, waiters := range patches {
+			if waiters != 1 {
+				t.Errorf("%d checks waiting for the patch, want 1", waiters)
+			}
+		}
+	}
+	close(gate.release)
+
+	var first *args.Result
+	for i := 0; i < n; i++ {
+		res := <-results
+		if res == nil {
+			continue
+		}
+		if first == nil {
+			first = res
+			continue
+		}
+		if res == first || res.PatchURL != first.PatchURL || res.Version != first.Version {
+			t.Errorf("result %+v is not a copy of %+v", res, first)
+		}
+	}
+	if len(gate.entered) != 0 {
+		t.Error("More than one patch generated")
+	}
+}
+
+func TestUpdateHandlerContentType(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.publish(t,
+		repo.release(2, "1.1.0", "linux_amd64"),
+		repo.release(1, "1.0.0", "linux_amd64"),
+	)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"update", `{"app_version": "1.0.0", "os": "linux", "arch": "amd64", "checksum": "` + testChecksum(testBinary("linux_amd64", "1.0.0")) + `"}`, http.StatusOK},
+		{"error", `{"app_version": "one", "os": "linux", "arch": "amd64", "checksum": "0"}`, http.StatusExpectationFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			new(updateHandler).ServeHTTP(w, httptest.NewRequest("POST", "/update", strings.NewReader(tt.body)))
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Content-Length = %q, want %d", cl, w.Body.Len())
+			}
+		})
+	}
+}
+
+func TestUpdateHandlerMethodNotAllowed(t *testing.T) {
+	for _, method := range []string{"GET", "PUT"} {
+		w := httptest.NewRecorder()
+		new(updateHandler).ServeHTTP(w, httptest.NewRequest(method, "/update", nil))
+
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: status = %d, want %d", method, w.Code, http.StatusMethodNotAllowed)
+		}
+		if allow := w.Header().Get("Allow"); allow != "POST" {
+			t.Errorf("%s: Allow = %q, want POST", method, allow)
+		}
+	}
+}
+
+func TestUpdateHandlerNotReady(t *testing.T) {
+	repo := newTestRepo(t)
+	srv := newUpdateServer(t)
+	params := args.Params{AppVersion: "1.0.0", OS: "linux", Arch: "amd64", Checksum: testChecksum(testBinary("linux_amd64", "1.0.0"))}
+
+	// Releases were not loaded yet.
+	res := postUpdate(t, srv, params)
+	var e args.Error
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable || e.Code != args.ERROR_NOT_READY {
+		t.Errorf("before the first refresh: %d %q, want %d %q", res.StatusCode, e.Code, http.StatusServiceUnavailable, args.ERROR_NOT_READY)
+	}
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("No Retry-After before the first refresh")
+	}
+
+	// Releases were loaded, none for the platform.
+	repo.publish(t, repo.release(1, "1.0.0", "windows_amd64"))
+	res = postUpdate(t, srv, params)
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNotFound || e.Code != args.ERROR_UNSUPPORTED_PLATFORM {
+		t.Errorf("without assets for the platform: %d %q, want %d %q", res.StatusCode, e.Code, http.StatusNotFound, args.ERROR_UNSUPPORTED_PLATFORM)
+	}
+}
+
+func TestUpdateHandlerParamsLimits(t *testing.T) {
+	newTestRepo(t)
+	savedSize, savedStrict := *flagMaxParamsSize, *flagStrictParams
+	t.Cleanup(func() { *flagMaxParamsSize, *flagStrictParams = savedSize, savedStrict })
+	*flagMaxParamsSize = 1024
+	*flagStrictParams = true
+
+	oversized := `{"app_version": "1.0.0", "tags": {"padding": "` + strings.Repeat("x", 2048) + `"}}`
+	compressed, err := gzipBytes([]byte(oversized))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		status   int
+	}{
+		{"oversized", []byte(oversized), "", http.StatusRequestEntityTooLarge},
+		{"oversized once decompressed", compressed, "gzip", http.StatusRequestEntityTooLarge},
+		{"unknown field", []byte(`{"app_version": "1.0.0", "platform": "linux"}`), "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/update", bytes.NewReader(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+		w := httptest.NewRecorder()
+		new(updateHandler).ServeHTTP(w, req)
+
+		var e args.Error
+		if err := json.NewDecoder(w.Body).Decode(&e); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if w.Code != tt.status || e.Code != args.ERROR_BAD_REQUEST {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, w.Code, e.Code, tt.status, args.ERROR_BAD_REQUEST)
+		}
+	}
+}
+
+func TestUpdateHandlerUpToDateIsNoMiss(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.publish(t,
+		repo.release(2, "1.1.0", "linux_amd64"),
+		repo.release(1, "1.0.0", "linux_amd64"),
+	)
+	srv := newUpdateServer(t)
+	saved := probes
+	t.Cleanup(func() { probes = saved })
+	probes = newProbeGuard(1, time.Minute, false)
+
+	latest := args.Params{AppVersion: "1.1.0", OS: "linux", Arch: "amd64", Checksum: testChecksum(testBinary("linux_amd64", "1.1.0"))}
+	channels := latest
+	channels.Channels = []string{"beta", "stable"}
+
+	// Identical checks are coalesced, only the params of the first one are
+	// checked.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, _ := json.Marshal(latest)
+			res, err := http.Post(srv.URL+"/update", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusNoContent {
+				t.Errorf("status = %d, want %d", res.StatusCode, http.StatusNoContent)
+			}
+		}()
+	}
+	wg.Wait()
+	if res := postUpdate(t, srv, channels); res.StatusCode != http.StatusNoContent {
+		t.Errorf("with channels: status = %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+
+	probes.misses.mu.Lock()
+	defer probes.misses.mu.Unlock()
+	if n := len(probes.misses.buckets); n != 0 {
+		t.Errorf("%d clients missed, want none", n)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// manifest lists releases built and hosted without GitHub or GitLab, e.g.:
+//
+//	{
+//	  "releases": [{
+//	    "version": "1.2.0",
+//	    "notes": "Bug fixes.",
+//	    "assets": [
+//	      {"os": "linux", "arch": "amd64", "url": "builds/1.2.0/app-linux", "sha256": "9f86d0..."},
+//	      {"os": "darwin", "arch": "arm64", "url": "https://cdn.example.com/1.2.0/app-darwin"}
+//	    ]
+//	  }]
+//	}
+//
+// Asset URLs may be paths, relative to the manifest file. Downloads are checked
+// against the SHA-256 checksum of assets giving one.
+type manifest struct {
+	Releases []manifestRelease `json:"releases"`
+}
+
+type manifestRelease struct {
+	Version    string          `json:"version"`
+	Title      string          `json:"title"`
+	Notes      string          `json:"notes"`
+	Prerelease bool            `json:"prerelease"`
+	Mandatory  bool            `json:"mandatory"`
+	Published  time.Time       `json:"published"`
+	Assets     []manifestAsset `json:"assets"`
+}
+
+type manifestAsset struct {
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifestSource is a ReleaseSource reading releases from a manifest file.
+// The same releases are listed for every repository.
+type manifestSource struct {
+	file string
+
+	mu sync.Mutex
+	// modTimes are the modification times of the file when the releases of
+	// each repository were last listed.
+	modTimes map[string]time.Time
+}
+
+// Releases reads the manifest file. It returns ErrNotModified if the file did
+// not change since the releases of the repository were last listed, and an
+// error if an asset is for an OS or architecture not in knownOSes and
+// knownArchs.
+func (s *manifestSource) Releases(owner, repo string) ([]Release, error) {
+	fi, err := os.Stat(s.file)
+	if err != nil {
+		return nil, err
+	}
+	key := owner + "/" + repo
+	s.mu.Lock()
+	modified := !fi.ModTime().Equal(s.modTimes[key])
+	s.mu.Unlock()
+	if !modified {
+		return nil, ErrNotModified
+	}
+
+	content, err := os.ReadFile(s.file)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err = json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("Could not parse manifest %s: %q", s.file, err)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(s.file))
+	if err != nil {
+		return nil, err
+	}
+
+	releases := make([]Release, 0, len(m.Releases))
+	for i, r := range m.Releases {
+		rel := Release{
+			// Releases are listed oldest first.
+			id:         i + 1,
+			Tag:        r.Version,
+			Rollout:    parseRollout(r.Notes),
+			Ramp:       parseRamp(r.Notes, r.Published),
+			Title:      r.Title,
+			Notes:      r.Notes,
+			Prerelease: r.Prerelease,
+			Mandatory:  r.Mandatory || parseMandatory(r.Notes),
+			Published:  r.Published,
+		}
+		rel.Assets = make([]Asset, 0, len(r.Assets))
+		for j, a := range r.Assets {
+			if a.OS == "" || a.Arch == "" || a.URL == "" {
+				log.Printf("Asset %d of release %q needs an os, an arch and a url. Skipping.", j, r.Version)
+				continue
+			}
+			if !contains(knownOSes, a.OS) {
+				return nil, fmt.Errorf("Asset %d of release %q in manifest %s has unknown OS %q", j, r.Version, s.file, a.OS)
+			}
+			if !contains(knownArchs, a.Arch) {
+				return nil, fmt.Errorf("Asset %d of release %q in manifest %s has unknown architecture %q", j, r.Version, s.file, a.Arch)
+			}
+			u := manifestURL(dir, a.URL)
+			rel.Assets = append(rel.Assets, Asset{
+				id:        j + 1,
+				Name:      path.Base(u),
+				URL:       u,
+				digest:    a.SHA256,
+				AssetInfo: AssetInfo{OS: a.OS, Arch: a.Arch},
+			})
+		}
+		logger.Info("Found release", "version", r.Version, "assets", len(rel.Assets))
+		releases = append(releases, rel)
+	}
+
+	s.mu.Lock()
+	if s.modTimes == nil {
+		s.modTimes = make(map[string]time.Time)
+	}
+	s.modTimes[key] = fi.ModTime()
+	s.mu.Unlock()
+
+	return releases, nil
+}
+
+// manifestURL turns the URL of a manifest asset into an absolute URL, a file
+// URL if it is a path, relative to dir or not.
+func manifestURL(dir string, s string) string {
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" && u.Host != "" {
+		return s
+	}
+	if !filepath.IsAbs(s) {
+		s = filepath.Join(dir, s)
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(s)}).String()
+}
+
+// fileTransport serves file URLs from disk and hands other requests to base.
+type fileTransport struct {
+	file http.RoundTripper
+	base http.RoundTripper
+}
+
+func (t *fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "file" {
+		return t.file.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newManifestClient creates the client downloading the assets of a manifest,
+// using base for remote ones.
+func newManifestClient(base http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: &fileTransport{file: http.NewFileTransport(http.Dir("/")), base: base},
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifestSourceUnknownPlatform(t *testing.T) {
+	for _, asset := range []string{
+		`{"os": "plan9", "arch": "amd64", "url": "app"}`,
+		`{"os": "linux", "arch": "sparc", "url": "app"}`,
+	} {
+		file := filepath.Join(t.TempDir(), "manifest.json")
+		content := `{"releases": [{"version": "1.0.0", "assets": [` + asset + `]}]}`
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s := &manifestSource{file: file}
+		if _, err := s.Releases("owner", "repo"); err == nil || !strings.Contains(err.Error(), "unknown") {
+			t.Errorf("%s: got error %v, want unknown platform", asset, err)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "manifest.json")
+	content := `{"releases": [{"version": "1.0.0", "assets": [{"os": "linux", "arch": "amd64", "url": "app"}]}]}`
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := (&manifestSource{file: file}).Releases("owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || len(rs[0].Assets) != 1 || rs[0].Assets[0].OS != "linux" {
+		t.Errorf("got releases %+v", rs)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+var (
+	updateChecksTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "autoupdate_update_checks_total",
+		Help: "Total number of update checks.",
+	})
+	updateResultsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autoupdate_update_results_total",
+		Help: "Number of updates offered, by initiative and patch type.",
+	}, []string{"initiative", "patch_type"})
+	patchDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "autoupdate_patch_generation_duration_seconds",
+		Help:    "Time spent generating patches.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	patchErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "autoupdate_patch_errors_total",
+		Help: "Number of failed patch generations.",
+	})
+	githubErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "autoupdate_github_errors_total",
+		Help: "Number of failed GitHub API calls.",
+	})
+	githubRateRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "autoupdate_github_rate_remaining",
+		Help: "GitHub API requests left before the rate limit resets.",
+	})
+	currentLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autoupdate_current_asset_lookups_total",
+		Help: "Number of lookups of the asset clients run, by what matched it (version or checksum, miss if nothing did), os and arch.",
+	}, []string{"result", "os", "arch"})
+	patchSizeDecisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "autoupdate_patch_size_decisions_total",
+		Help: "Number of generated patches offered (patch) or discarded for being too large compared to the update (full).",
+	}, []string{"outcome"})
+	blockedChecksTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "autoupdate_blocked_checks_total",
+		Help: "Number of update checks refused to clients blocked for sending unknown checksums.",
+	})
+	knownAssets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "autoupdate_known_assets",
+		Help: "Number of known os/arch/version assets, by repository.",
+	}, []string{"repo"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		updateChecksTotal,
+		updateResultsTotal,
+		patchDurationSeconds,
+		patchErrorsTotal,
+		githubErrorsTotal,
+		githubRateRemaining,
+		currentLookupsTotal,
+		patchSizeDecisionsTotal,
+		blockedChecksTotal,
+		knownAssets,
+	)
+}
+
+// observeResult records the outcome of an update check.
+func observeResult(res *args.Result, err error) {
+	updateChecksTotal.Inc()
+	if err != nil || res == nil {
+		return
+	}
+	patchType := string(res.PatchType)
+	if patchType == "" {
+		patchType = "none"
+	}
+	updateResultsTotal.WithLabelValues(string(res.Initiative), patchType).Inc()
+}
+
+// observeCurrentLookup records how the asset a client runs was found.
+func observeCurrentLookup(result string, p *args.Params) {
+	currentLookupsTotal.WithLabelValues(result, p.OS, p.Arch).Inc()
+}
+
+// observePatchDuration records the time elapsed since start as a patch
+// generation duration.
+func observePatchDuration(start time.Time) {
+	patchDurationSeconds.Observe(time.Since(start).Seconds())
+}
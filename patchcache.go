@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// patchCache keeps track of the patches in use, least recently used last, and
+// forgets the oldest ones past maxEntries patches or maxBytes bytes. A zero
+// limit means no limit.
+type patchCache struct {
+	maxEntries  int
+	maxBytes    int64
+	deleteFiles bool
+
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+	bytes   int64
+}
+
+type patchEntry struct {
+	file string
+	size int64
+}
+
+// patchLRU holds the patches generated or served, it is unbounded unless
+// setPatchCacheLimits is called.
+var patchLRU = newPatchCache(0, 0, false)
+
+func newPatchCache(maxEntries int, maxBytes int64, deleteFiles bool) *patchCache {
+	return &patchCache{
+		maxEntries:  maxEntries,
+		maxBytes:    maxBytes,
+		deleteFiles: deleteFiles,
+		ll:          list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+}
+
+// setPatchCacheLimits bounds the patch cache, deleting the files of evicted
+// patches if deleteFiles is set.
+func setPatchCacheLimits(maxEntries int, maxBytes int64, deleteFiles bool) {
+	patchLRU = newPatchCache(maxEntries, maxBytes, deleteFiles)
+}
+
+// touch records a use of the patch file, evicting the least recently used
+// patches if the cache grows past its limits.
+func (c *patchCache) touch(file string, size int64) {
+	key := filepath.Clean(file)
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*patchEntry)
+		c.bytes += size - entry.size
+		entry.size = size
+		c.ll.MoveToFront(e)
+	} else {
+		c.entries[key] = c.ll.PushFront(&patchEntry{file: key, size: size})
+		c.bytes += size
+	}
+
+	var evicted []string
+	for c.ll.Len() > 1 && c.overLimits() {
+		entry := c.ll.Remove(c.ll.Back()).(*patchEntry)
+		delete(c.entries, entry.file)
+		c.bytes -= entry.size
+		evicted = append(evicted, entry.file)
+	}
+	c.mu.Unlock()
+
+	if len(evicted) == 0 {
+		return
+	}
+
+	verifiedPatchesMu.Lock()
+	for _, file := range evicted {
+		delete(verifiedPatches, file)
+	}
+	verifiedPatchesMu.Unlock()
+
+	if c.deleteFiles {
+		// Patches are read-locked while being generated, which the caller
+		// may be doing.
+		go c.removeFiles(evicted)
+	}
+}
+
+// forget drops the patch file from the cache, if it is there.
+func (c *patchCache) forget(file string) {
+	key := filepath.Clean(file)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.ll.Remove(e)
+		delete(c.entries, key)
+		c.bytes -= e.Value.(*patchEntry).size
+	}
+}
+
+// overLimits tells whether the cache holds too much. The caller must hold
+// c.mu.
+func (c *patchCache) overLimits() bool {
+	return (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) ||
+		(c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+// removeFiles removes the files of evicted patches, unless they were used
+// again in the meantime.
+func (c *patchCache) removeFiles(files []string) {
+	patchDirMu.Lock()
+	defer patchDirMu.Unlock()
+
+	for _, file := range files {
+		c.mu.Lock()
+		_, used := c.entries[file]
+		c.mu.Unlock()
+		if used {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Could not remove evicted patch", "file", file, "error", err)
+			continue
+		}
+		logger.Info("Removed evicted patch", "file", file)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+// Patcher generates and applies binary patches of a type.
+type Patcher interface {
+	// Type is the patch type told to clients.
+	Type() args.PatchType
+	// Diff writes to patchfile the patch going from oldfile to newfile.
+	Diff(ctx context.Context, oldfile string, newfile string, patchfile string) error
+	// Apply writes to newfile the result of applying patchfile to oldfile.
+	Apply(oldfile string, newfile string, patchfile string) error
+}
+
+var (
+	// defaultPatcher makes the patches of platforms without a patcher of
+	// their own, and of clients not supporting it.
+	defaultPatcher Patcher = bsdiffPatcher{}
+	// osPatchers are the patchers by OS, see -patcher.
+	osPatchers = map[string]Patcher{}
+)
+
+// bsdiffPatcher makes patches with the bsdiff and bspatch programs.
+type bsdiffPatcher struct{}
+
+func (bsdiffPatcher) Type() args.PatchType {
+	return args.PATCHTYPE_BSDIFF
+}
+
+func (bsdiffPatcher) Diff(ctx context.Context, oldfile string, newfile string, patchfile string) error {
+	cmd := exec.CommandContext(
+		ctx,
+		"bsdiff",
+		oldfile,
+		newfile,
+		patchfile,
+	)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to generate patch with bsdiff: %q", err)
+	}
+	return nil
+}
+
+func (bsdiffPatcher) Apply(oldfile string, newfile string, patchfile string) error {
+	cmd := exec.Command(
+		"bspatch",
+		oldfile,
+		newfile,
+		patchfile,
+	)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to apply patch with bspatch: %q", err)
+	}
+	return nil
+}
+
+// courgettePatcher makes patches with Chromium's courgette program, which
+// are much smaller than bsdiff ones for executables with relocations.
+type courgettePatcher struct{}
+
+func (courgettePatcher) Type() args.PatchType {
+	return args.PATCHTYPE_COURGETTE
+}
+
+func (courgettePatcher) Diff(ctx context.Context, oldfile string, newfile string, patchfile string) error {
+	cmd := exec.CommandContext(
+		ctx,
+		"courgette",
+		"-gen",
+		oldfile,
+		newfile,
+		patchfile,
+	)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to generate patch with courgette: %q", err)
+	}
+	return nil
+}
+
+func (courgettePatcher) Apply(oldfile string, newfile string, patchfile string) error {
+	cmd := exec.Command(
+		"courgette",
+		"-apply",
+		oldfile,
+		patchfile,
+		newfile,
+	)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to apply patch with courgette: %q", err)
+	}
+	return nil
+}
+
+// patcherNamed returns the patcher of a -patcher name.
+func patcherNamed(name string) (Patcher, error) {
+	switch name {
+	case "bsdiff":
+		return bsdiffPatcher{}, nil
+	case "courgette":
+		return courgettePatcher{}, nil
+	}
+	return nil, fmt.Errorf("unknown patcher %q, expecting bsdiff or courgette", name)
+}
+
+// setPatchers sets the patchers by OS from a list such as
+// "windows=courgette,linux=courgette".
+func setPatchers(list string) error {
+	patchers := map[string]Patcher{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("expecting os=patcher, got %q", item)
+		}
+		patcher, err := patcherNamed(parts[1])
+		if err != nil {
+			return err
+		}
+		patchers[parts[0]] = patcher
+	}
+	osPatchers = patchers
+	return nil
+}
+
+// patcherFor returns the patcher of the client's OS if the client supports
+// its patches, the default patcher otherwise.
+func patcherFor(p *args.Params) Patcher {
+	if patcher := osPatchers[p.OS]; patcher != nil && supportsPatchType(p, patcher.Type()) {
+		return patcher
+	}
+	return defaultPatcher
+}
+
+// patchersOf returns the patchers making patches for os: its own, if any,
+// and the default one for the clients not supporting it.
+func patchersOf(os string) []Patcher {
+	if patcher := osPatchers[os]; patcher != nil && patcher.Type() != defaultPatcher.Type() {
+		return []Patcher{patcher, defaultPatcher}
+	}
+	return []Patcher{defaultPatcher}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// patchesHandler serves patch files from the patch storage with caching
+// headers. Patch files are named after the hashes of the files they go from
+// and to, so they never change once generated and their names make strong
+// ETags. Clients are redirected to storages with URLs of their own. Patches
+// that could not be stored are served from dir.
+type patchesHandler struct {
+	storage Storage
+	dir     string
+}
+
+func newPatchesHandler(storage Storage, dir string) *patchesHandler {
+	return &patchesHandler{
+		storage: storage,
+		dir:     dir,
+	}
+}
+
+func (h *patchesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(path.Clean("/" + r.URL.Path))
+	if isUnpublished(name) {
+		fp, err := os.Open(filepath.Join(h.dir, name))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer fp.Close()
+		h.serve(w, r, name, fp)
+		return
+	}
+	if found, err := h.storage.Exists(name); err != nil || !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	if u, err := h.storage.URL(name); err == nil && u != "" {
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	rc, err := h.storage.Get(name)
+	if err != nil {
+		log.Printf("Could not get patch %s: %q", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	h.serve(w, r, name, rc)
+}
+
+// serve writes the content of the named patch.
+func (h *patchesHandler) serve(w http.ResponseWriter, r *http.Request, name string, rc io.Reader) {
+	w.Header().Set("ETag", `"`+name+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		// http.ServeContent honors If-None-Match against the ETag.
+		http.ServeContent(w, r, name, time.Time{}, rs)
+		return
+	}
+	io.Copy(w, rc)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+// platformsHandler lists the operating systems and architectures clients may
+// ask updates for, and the platforms an application has updates for:
+//
+//	GET /platforms?app=other
+type platformsHandler struct{}
+
+// platformsList is the answer of platformsHandler.
+type platformsList struct {
+	OS        []string   `json:"os"`
+	Arch      []string   `json:"arch"`
+	Available []Platform `json:"available"`
+}
+
+func (h *platformsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, args.ERROR_METHOD_NOT_ALLOWED, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	m, err := apps.Get(r.URL.Query().Get("app"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errorCode(err), err.Error())
+		return
+	}
+
+	writeJSON(w, platformsList{
+		OS:        knownOSes,
+		Arch:      knownArchs,
+		Available: m.Platforms(),
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPlatformsHandler(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.publish(t, repo.release(1, "1.0.0", "windows_386", "linux_amd64"))
+
+	w := httptest.NewRecorder()
+	new(platformsHandler).ServeHTTP(w, httptest.NewRequest("GET", "/platforms", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var list platformsList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list.OS, knownOSes) || !reflect.DeepEqual(list.Arch, knownArchs) {
+		t.Errorf("supported %v %v, want %v %v", list.OS, list.Arch, knownOSes, knownArchs)
+	}
+	if want := []Platform{{"linux", "amd64"}, {"windows", "386"}}; !reflect.DeepEqual(list.Available, want) {
+		t.Errorf("available %v, want %v", list.Available, want)
+	}
+
+	w = httptest.NewRecorder()
+	new(platformsHandler).ServeHTTP(w, httptest.NewRequest("GET", "/platforms?app=other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown app: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
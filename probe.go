@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+// probes blocks clients sending checksums of no known asset too often, which
+// may be scanning for patches. It is nil unless -max-checksum-misses is set.
+var probes *probeGuard
+
+// probeGuard counts the update checks of each client whose checksum matches
+// no known asset, and blocks clients exceeding their allowance for a while.
+type probeGuard struct {
+	misses     *rateLimiter
+	blockFor   time.Duration
+	trustProxy bool
+
+	mu        sync.Mutex
+	blocked   map[string]time.Time
+	lastSweep time.Time
+}
+
+// newProbeGuard allows clients maxMisses unknown checksums per window, and
+// blocks the ones sending more for window.
+func newProbeGuard(maxMisses int, window time.Duration, trustProxy bool) *probeGuard {
+	return &probeGuard{
+		misses:     newRateLimiter(float64(maxMisses)/window.Seconds(), maxMisses),
+		blockFor:   window,
+		trustProxy: trustProxy,
+		blocked:    make(map[string]time.Time),
+		lastSweep:  time.Now(),
+	}
+}
+
+// Blocked tells whether the client is blocked.
+func (g *probeGuard) Blocked(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(g.lastSweep) > rateLimitSweepInterval {
+		g.sweep(now)
+	}
+
+	until, ok := g.blocked[ip]
+	if ok && now.After(until) {
+		delete(g.blocked, ip)
+		return false
+	}
+	return ok
+}
+
+// sweep drops the blocks that are over, of clients that did not come back.
+// The caller must hold g.mu.
+func (g *probeGuard) sweep(now time.Time) {
+	for ip, until := range g.blocked {
+		if now.After(until) {
+			delete(g.blocked, ip)
+		}
+	}
+	g.lastSweep = now
+}
+
+// Miss counts an unknown checksum sent by the client, and blocks it if it
+// sent too many.
+func (g *probeGuard) Miss(ip string, p *args.Params) {
+	if g.misses.Allow(ip) {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.blocked[ip]; !ok {
+		logger.Warn("Blocking client sending unknown checksums", "ip", ip, "os", p.OS, "arch", p.Arch, "checksum", p.Checksum, "duration", g.blockFor)
+	}
+	g.blocked[ip] = time.Now().Add(g.blockFor)
+}
+
+// knowsCurrent tells whether the asset the client runs is known, by version
+// or by checksum.
+func (a *AppRegistry) knowsCurrent(p *args.Params) bool {
+	m, err := a.Get(p.AppId)
+	if err != nil {
+		return false
+	}
+	if p.FromVersion != "" && m.lookupAssetWithVersion(p.OS, p.Arch, p.FromVersion) != nil {
+		return true
+	}
+	_, err = m.lookupAssetWithChecksum(p.OS, p.Arch, p.ChecksumAlgorithm, p.Checksum)
+	return err == nil
+}
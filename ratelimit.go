@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often idle buckets are dropped.
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds the tokens left for a client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter keyed by client.
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of key and tells whether there was one.
+func (l *rateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets that have refilled completely, they are no different
+// from new ones. The caller must hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimitHandler rejects requests of clients exceeding their rate with
+// 429 Too Many Requests.
+type rateLimitHandler struct {
+	limiter    *rateLimiter
+	trustProxy bool
+	next       http.Handler
+}
+
+func (h *rateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.limiter.Allow(clientIP(r, h.trustProxy)) {
+		writeStatus(w, http.StatusTooManyRequests)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// clientIP returns the address of the client that sent r. When behind a
+// trusted proxy, it is the last address of X-Forwarded-For, the one the proxy
+// appended: the ones before come from the client and can be forged.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
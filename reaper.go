@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backgroundReap periodically removes stale assets and patches.
+func backgroundReap(interval time.Duration, ttl time.Duration) {
+	for {
+		time.Sleep(interval)
+		reapAssets(*flagAssetDir, apps.LocalFiles(), ttl)
+		if !noPatches {
+			reapPatches(*flagPatchDir, ttl)
+		}
+	}
+}
+
+// reapAssets removes files from assetDir that belong to no known asset and
+// were not modified within ttl, which spares downloads in progress.
+func reapAssets(assetDir string, referenced map[string]bool, ttl time.Duration) {
+	inUse := make(map[string]bool)
+	for file := range referenced {
+		inUse[filepath.Clean(file)] = true
+	}
+
+	reapDir(assetDir, ttl, func(file string) bool {
+		if strings.HasSuffix(file, ".json") {
+			// Asset caches.
+			return false
+		}
+		file = strings.TrimSuffix(file, ".sha256")
+		file = strings.TrimSuffix(file, ".part")
+		return !inUse[filepath.Clean(file)]
+	})
+}
+
+// reapPatches removes patches that were not generated or served within ttl.
+// Patch generation is held off while reaping.
+func reapPatches(patchDir string, ttl time.Duration) {
+	patchDirMu.Lock()
+	defer patchDirMu.Unlock()
+
+	reapDir(patchDir, ttl, func(file string) bool {
+		verifiedPatchesMu.Lock()
+		delete(verifiedPatches, filepath.Clean(file))
+		verifiedPatchesMu.Unlock()
+		patchLRU.forget(file)
+		return true
+	})
+}
+
+// reapDir removes regular files in dir older than ttl for which stale
+// returns true.
+func reapDir(dir string, ttl time.Duration, stale func(file string) bool) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logger.Warn("Could not read directory", "dir", dir, "error", err)
+		return
+	}
+
+	deadline := time.Now().Add(-ttl)
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || fi.ModTime().After(deadline) {
+			continue
+		}
+		file := filepath.Join(dir, fi.Name())
+		if !stale(file) {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			logger.Warn("Could not remove stale file", "file", file, "error", err)
+			continue
+		}
+		logger.Info("Removed stale file", "file", file)
+	}
+}
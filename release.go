@@ -1,32 +1,105 @@
 package main
 
 import (
-	"crypto/rsa"
+	"context"
+	"crypto"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"path"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/blang/semver"
 	"github.com/google/go-github/github"
 	"github.com/yinghuocho/autoupdate-server/args"
+	"github.com/yinghuocho/autoupdate-server/verify"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
-var (
-	updateAssetRe = regexp.MustCompile(`^update_(darwin|windows|linux)_(arm|386|amd64)\.?.*$`)
-	emptyVersion  semver.Version
+const (
+	// stableChannel is the channel of releases without a pre-release version.
+	stableChannel = "stable"
+
+	// releasesRetries bounds the attempts at listing releases.
+	releasesRetries      = 4
+	releasesRetryBackoff = 2 * time.Second
+	// releasesRetryMaxWait is the longest wait for a rate limit to reset
+	// before trying again, later resets are left to the next refresh.
+	releasesRetryMaxWait = time.Minute
 )
 
+var emptyVersion semver.Version
+
+// dryRun tells to only classify assets, without downloading nor signing
+// them.
+var dryRun bool
+
+// prereleaseChannel is the channel of releases marked as pre-releases on
+// GitHub whose version has no pre-release part.
+var prereleaseChannel = "prerelease"
+
+// assetPreference lists asset name suffixes, most preferred first, to choose
+// between update assets of the same platform in a release.
+var assetPreference []string
+
+// maxVersion is the newest version offered to clients but canaries, there is
+// no ceiling when empty. Raising it promotes the versions held back.
+var maxVersion semver.Version
+
+// bakePeriod is how long releases are held back from clients but canaries
+// after being published, none if 0.
+var bakePeriod time.Duration
+
+// assetWorkers is how many assets Refresh downloads and signs at once.
+var assetWorkers = 4
+
+// Update policies, telling which versions clients are offered.
+const (
+	// policyLatest offers the newest version.
+	policyLatest = "latest"
+	// policySameMajor offers the newest version of the client's major
+	// version.
+	policySameMajor = "same-major"
+)
+
+// updatePolicy is the policy CheckForUpdate applies.
+var updatePolicy = policyLatest
+
+// canaryTag is the tag canary clients set to "true", they are offered
+// versions above maxVersion.
+var canaryTag = "canary"
+
+// forceVersionTag is the tag test clients set to the version they must be
+// offered, it is only honored if allowForceVersion is set.
+const forceVersionTag = "force_version"
+
+// allowForceVersion tells whether clients may ask for a version with
+// forceVersionTag. It must stay off in production.
+var allowForceVersion bool
+
+// minAutoVersion is the oldest client version updated automatically, older
+// clients are asked to update manually.
+var minAutoVersion semver.Version
+
 // Arch holds architecture names.
 var Arch = struct {
-	X64 string
-	X86 string
-	ARM string
+	X64   string
+	X86   string
+	ARM   string
+	ARM64 string
 }{
 	"amd64",
 	"386",
 	"arm",
+	"arm64",
 }
 
 // OS holds operating system names.
@@ -40,12 +113,32 @@ var OS = struct {
 	"darwin",
 }
 
-// Release struct represents a single github release.
+// knownOSes and knownArchs list the operating systems and architectures
+// recognized in asset names.
+var (
+	knownOSes  = []string{OS.Windows, OS.Linux, OS.Darwin}
+	knownArchs = []string{Arch.X64, Arch.X86, Arch.ARM, Arch.ARM64}
+)
+
+// Release struct represents a single release, as published on GitHub or GitLab.
 type Release struct {
-	id      int
-	URL     string
+	id  int
+	URL string
+	// Tag names the release, Version is parsed from it.
+	Tag     string
 	Version semver.Version
-	Assets  []Asset
+	Rollout int
+	// Ramp raises Rollout over time, if set.
+	Ramp *rampSchedule
+	// Mandatory releases are applied automatically and cannot be postponed.
+	Mandatory bool
+	// Published is when the release was published, zero if unknown.
+	Published time.Time
+	Title     string
+	Notes     string
+	// Prerelease is set for releases marked as pre-releases on GitHub.
+	Prerelease bool
+	Assets     []Asset
 }
 
 type releasesByID []Release
@@ -54,11 +147,27 @@ type releasesByID []Release
 type Asset struct {
 	id        int
 	v         semver.Version
+	rollout   int
+	ramp      *rampSchedule
+	mandatory bool
+	published time.Time
+	minOS     semver.Version
+	size      int64
+	// digest is the published SHA-256 checksum of the file at URL, and
+	// digestURL the URL of a file holding it, if any.
+	digest    string
+	digestURL string
+	title     string
+	notes     string
+	channel   string
 	Name      string
 	URL       string
 	LocalFile string
 	Checksum  string
 	Signature string
+	// signatures by key ID, when signing with several keys.
+	signatures map[string]string
+	checksums  map[args.ChecksumAlgorithm]string
 	AssetInfo
 }
 
@@ -66,19 +175,38 @@ type Asset struct {
 type AssetInfo struct {
 	OS   string
 	Arch string
+	// version found in the asset name, if any.
+	version string
+}
+
+// ReleaseSource lists the releases of a repository, normalized to Release
+// values. Implementations exist for GitHub, GitLab and manifest files.
+type ReleaseSource interface {
+	Releases(owner, repo string) ([]Release, error)
 }
 
 // ReleaseManager struct defines a repository to pull releases from.
 type ReleaseManager struct {
-	client          *github.Client
-	owner           string
-	repo            string
-	assetDir        string
-	patchDir        string
-	privKey         *rsa.PrivateKey
+	source   ReleaseSource
+	owner    string
+	repo     string
+	assetDir string
+	patchDir string
+	// signers sign assets, the first one makes Asset.Signature.
+	signers         []crypto.Signer
 	updateAssetsMap map[string]map[string]map[string]*Asset
-	latestAssetsMap map[string]map[string]*Asset
+	latestAssetsMap map[string]map[string]map[string]*Asset
 	mu              *sync.RWMutex
+	// releases are the releases last listed, and complete tells whether all
+	// of their assets were pushed. Both are only used by Refresh.
+	releases []Release
+	complete bool
+	// failedAssets is how many assets the last refresh could not push.
+	failedAssets int
+	lastRefresh  time.Time
+	// rampPeaks are the highest percentages applied to ramped versions.
+	rampPeaks map[string]int
+	rampMu    sync.Mutex
 }
 
 func (a releasesByID) Len() int {
@@ -93,130 +221,404 @@ func (a releasesByID) Less(i, j int) bool {
 	return a[i].id < a[j].id
 }
 
-// NewReleaseManager creates a wrapper of github.Client.
-func NewReleaseManager(owner string, repo string, assetDir string, patchDir string, privKey *rsa.PrivateKey) *ReleaseManager {
+// NewReleaseManager creates a ReleaseManager listing releases from source,
+// or from github.com without authentication if source is nil. Assets are
+// signed with each of signers.
+func NewReleaseManager(source ReleaseSource, owner string, repo string, assetDir string, patchDir string, signers ...crypto.Signer) *ReleaseManager {
+	if source == nil {
+		source = &githubSource{client: github.NewClient(nil).Repositories}
+	}
 
 	ghc := &ReleaseManager{
-		client:          github.NewClient(nil),
+		source:          source,
 		owner:           owner,
 		repo:            repo,
 		assetDir:        assetDir,
 		patchDir:        patchDir,
-		privKey:         privKey,
+		signers:         signers,
 		mu:              new(sync.RWMutex),
 		updateAssetsMap: make(map[string]map[string]map[string]*Asset),
-		latestAssetsMap: make(map[string]map[string]*Asset),
+		latestAssetsMap: make(map[string]map[string]map[string]*Asset),
 	}
 
 	return ghc
 }
 
-// getReleases queries github for all product releases.
-func (g *ReleaseManager) getReleases() ([]Release, error) {
-	var releases []Release
+// getReleases queries the release source for all product releases.
+func (g *ReleaseManager) getReleases(ctx context.Context) ([]Release, error) {
+	ctx, span := tracer.Start(ctx, "list releases")
+	span.SetAttributes(attribute.String("repo", g.owner+"/"+g.repo))
+	defer span.End()
+
+	releases, err := g.listReleases(ctx)
+	if err == ErrNotModified {
+		span.SetAttributes(attribute.Bool("not_modified", true))
+		return nil, err
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("releases", len(releases)))
+
+	versioned := releases[:0]
+	for _, rel := range releases {
+		if rel.Version, err = tagParser.ParseTag(rel.Tag); err != nil {
+			log.Printf("Release %q has no version (%q). Skipping.", rel.Tag, err)
+			continue
+		}
+		versioned = append(versioned, rel)
+	}
+	releases = versioned
 
-	for page := 1; true; page++ {
-		opt := &github.ListOptions{Page: page}
+	sort.Sort(sort.Reverse(releasesByID(releases)))
 
-		rels, _, err := g.client.Repositories.ListReleases(g.owner, g.repo, opt)
+	return releases, nil
+}
 
-		if err != nil {
+// listReleases lists the releases of the repository, retrying with
+// exponential backoff after errors that may be transient, until ctx is done.
+func (g *ReleaseManager) listReleases(ctx context.Context) (releases []Release, err error) {
+	backoff := releasesRetryBackoff
+	for i := 1; ; i++ {
+		if releases, err = g.source.Releases(g.owner, g.repo); err == nil || err == ErrNotModified {
+			return releases, err
+		}
+		retry, wait := retryableReleasesError(err)
+		if !retry || i >= releasesRetries {
 			return nil, err
 		}
-
-		if len(rels) == 0 {
-			break
+		if wait < backoff {
+			wait = jitter(backoff, 0.5)
+		}
+		log.Printf("Listing releases of %s/%s failed (attempt %d of %d), retrying in %s: %q", g.owner, g.repo, i, releasesRetries, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
+		backoff *= 2
+	}
+}
 
-		releases = make([]Release, 0, len(rels))
+// retryableReleasesError tells whether listing releases may succeed if tried
+// again after err, and how long to wait at least. Authentication failures and
+// other client errors are not retried, nor rate limits resetting too late.
+func retryableReleasesError(err error) (retry bool, wait time.Duration) {
+	if reset, ok := rateLimitReset(err); ok {
+		wait = time.Until(reset) + time.Second
+		return wait <= releasesRetryMaxWait, wait
+	}
 
-		for i := range rels {
-			version := *rels[i].TagName
-			v, err := semver.Parse(version)
-			if err != nil {
-				log.Printf("Release %q is not semantically versioned (%q). Skipping.", version, err)
-				continue
-			}
-			rel := Release{
-				id:      *rels[i].ID,
-				URL:     *rels[i].ZipballURL,
-				Version: v,
-			}
-			rel.Assets = make([]Asset, 0, len(rels[i].Assets))
-			for _, asset := range rels[i].Assets {
-				rel.Assets = append(rel.Assets, Asset{
-					id:   *asset.ID,
-					Name: *asset.Name,
-					URL:  *asset.BrowserDownloadURL,
-				})
-			}
-			log.Printf("Release %q has %d assets...", version, len(rel.Assets))
-			releases = append(releases, rel)
-		}
+	var ghErr *github.ErrorResponse
+	var stErr *statusError
+	status := 0
+	switch {
+	case errors.As(err, &ghErr) && ghErr.Response != nil:
+		status = ghErr.Response.StatusCode
+	case errors.As(err, &stErr):
+		status = stErr.StatusCode
+	}
+	if status != 0 {
+		return status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests, 0
 	}
 
-	sort.Sort(sort.Reverse(releasesByID(releases)))
+	// Network errors.
+	var netErr net.Error
+	return errors.As(err, &netErr), 0
+}
 
-	return releases, nil
+// RefreshSummary reports the outcome of a scan of published releases.
+type RefreshSummary struct {
+	Releases    int  `json:"releases"`
+	Assets      int  `json:"assets"`
+	Failed      int  `json:"failed"`
+	NotModified bool `json:"not_modified,omitempty"`
 }
 
 // UpdateAssetsMap will pull published releases, scan for compatible
 // update-only binaries and will add them to the updateAssetsMap.
 func (g *ReleaseManager) UpdateAssetsMap() (err error) {
+	_, err = g.Refresh(context.Background())
+	return err
+}
+
+// Refresh does the same as UpdateAssetsMap and reports how many releases were
+// scanned and how many assets were pushed. It gives up waiting to retry
+// listing releases when ctx is done.
+func (g *ReleaseManager) Refresh(ctx context.Context) (summary *RefreshSummary, err error) {
 
 	var rs []Release
 
 	log.Printf("Getting releases...")
-	if rs, err = g.getReleases(); err != nil {
-		return err
+	if rs, err = g.getReleases(ctx); err == ErrNotModified {
+		if g.complete {
+			log.Printf("Releases not modified.")
+			g.mu.Lock()
+			g.lastRefresh = time.Now()
+			g.mu.Unlock()
+			return &RefreshSummary{NotModified: true}, nil
+		}
+		// Retry the assets that failed last time.
+		rs, err = g.releases, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+	g.releases = rs
+	complete := !dryRun
+
+	summary = &RefreshSummary{Releases: len(rs)}
 
 	log.Printf("Getting assets...")
+	var pending []*Asset
 	for i := range rs {
 		log.Printf("Getting assets for release %q...", rs[i].Version)
+		var candidates []*Asset
+		// Assets may come with a sidecar holding their checksum, named
+		// after them with a .sha256 suffix.
+		names := make(map[string]bool)
+		for _, a := range rs[i].Assets {
+			names[a.Name] = true
+		}
+		sidecars := make(map[string]string)
+		for _, a := range rs[i].Assets {
+			if name := strings.TrimSuffix(a.Name, ".sha256"); name != a.Name && names[name] {
+				sidecars[name] = a.URL
+			}
+		}
 		for j := range rs[i].Assets {
 			log.Printf("Found %q.", rs[i].Assets[j].Name)
-			// Does this asset represent a binary update?
-			if isUpdateAsset(rs[i].Assets[j].Name) {
+			if name := strings.TrimSuffix(rs[i].Assets[j].Name, ".sha256"); sidecars[name] != "" && name != rs[i].Assets[j].Name {
+				log.Printf("%q is a checksum file. Skipping.", rs[i].Assets[j].Name)
+				continue
+			}
+			// Does this asset represent a binary update? Sources may tell
+			// its platform, as manifests do.
+			if rs[i].Assets[j].OS != "" || assetClassifier.IsUpdate(rs[i].Assets[j].Name) {
 				log.Printf("%q is an auto-update asset.", rs[i].Assets[j].Name)
 				asset := rs[i].Assets[j]
 				asset.v = rs[i].Version
-				info, err := getAssetInfo(asset.Name)
+				asset.rollout = rs[i].Rollout
+				asset.ramp = rs[i].Ramp
+				asset.mandatory = rs[i].Mandatory
+				asset.published = rs[i].Published
+				if asset.digest == "" {
+					asset.digestURL = sidecars[asset.Name]
+				}
+				asset.title = rs[i].Title
+				asset.notes = rs[i].Notes
+				info := &asset.AssetInfo
+				var err error
+				if asset.OS == "" {
+					info, err = assetClassifier.Info(asset.Name)
+				}
 				if err != nil {
-					return fmt.Errorf("Could not get asset info: %q", err)
+					logger.Error("Could not get asset info, skipping", "name", asset.Name, "error", err)
+					summary.Failed++
+					complete = false
+					continue
+				}
+				if info.version != "" {
+					// The asset name tells its own version.
+					v, err := tagParser.ParseTag(info.version)
+					if err != nil {
+						logger.Warn("Asset version is not semantic, skipping", "name", asset.Name, "version", info.version)
+						continue
+					}
+					asset.v = v
 				}
-				if err = g.pushAsset(info.OS, info.Arch, &asset); err != nil {
-					return fmt.Errorf("Could not push asset: %q", err)
+				asset.channel = channelOf(asset.v)
+				if rs[i].Prerelease && asset.channel == stableChannel {
+					// Never offer a GitHub pre-release to stable clients.
+					asset.channel = prereleaseChannel
 				}
+				asset.AssetInfo = AssetInfo{OS: info.OS, Arch: info.Arch}
+				if asset.minOS, err = minOSVersion(asset.Name); err != nil {
+					logger.Warn("Asset minimum OS version is not valid, skipping", "name", asset.Name, "error", err)
+					continue
+				}
+				candidates = append(candidates, &asset)
 			} else {
 				log.Printf("%q is not an auto-update asset. Skipping.", rs[i].Assets[j].Name)
 			}
 		}
+		for _, asset := range selectAssets(candidates) {
+			if dryRun {
+				logger.Info("Would push asset", "name", asset.Name, "os", asset.OS, "arch", asset.Arch, "version", asset.v.String())
+				summary.Assets++
+				continue
+			}
+			pending = append(pending, asset)
+		}
 	}
 
-	return nil
+	// Assets are pushed in the order they were found whatever the order
+	// they were fetched in, so that the same latest assets are chosen.
+	var assets []*Asset
+	for i, err := range g.fetchAssets(pending) {
+		asset := pending[i]
+		if err != nil {
+			// Skip it, the other assets can still be served.
+			logger.Error("Could not push asset, skipping", "name", asset.Name, "error", err)
+			summary.Failed++
+			complete = false
+			// Keep serving the copy fetched before, if any.
+			g.mu.RLock()
+			known := g.knownAsset(asset.OS, asset.Arch, asset.v.String())
+			g.mu.RUnlock()
+			if known != nil {
+				assets = append(assets, known)
+			}
+			continue
+		}
+		assets = append(assets, asset)
+		summary.Assets++
+	}
+	if !dryRun {
+		g.replaceAssets(assets)
+	}
+
+	if err = g.saveCache(); err != nil {
+		logger.Warn("Could not save asset cache", "error", err)
+	}
+	g.complete = complete
+
+	g.mu.Lock()
+	g.failedAssets = summary.Failed
+	g.lastRefresh = time.Now()
+	g.mu.Unlock()
+
+	return summary, nil
+}
+
+// updateLimits restrict the assets offered to a client.
+type updateLimits struct {
+	// ceiling is the newest version offered, there is none if empty.
+	ceiling semver.Version
+	// major is the only major version offered, any if negative.
+	major int64
+	// osVersion is the version of the client's OS, unknown if empty.
+	osVersion semver.Version
+	// bakedBefore is the time assets must have been published before, any
+	// time if zero.
+	bakedBefore time.Time
+	// rollout tells whether the client is part of the rollout of an asset,
+	// of all of them if nil.
+	rollout func(a *Asset) bool
 }
 
-func (g *ReleaseManager) getProductUpdate(os string, arch string) (asset *Asset, err error) {
+// allows tells whether asset may be offered.
+func (l *updateLimits) allows(a *Asset) bool {
+	if !l.ceiling.Equals(emptyVersion) && a.v.GT(l.ceiling) {
+		return false
+	}
+	if l.major >= 0 && a.v.Major != uint64(l.major) {
+		return false
+	}
+	if !l.osVersion.Equals(emptyVersion) && a.minOS.GT(l.osVersion) {
+		return false
+	}
+	if !l.bakedBefore.IsZero() && a.published.After(l.bakedBefore) {
+		return false
+	}
+	if l.rollout != nil && !l.rollout(a) {
+		return false
+	}
+	return true
+}
+
+// getProductUpdate returns the latest asset for the os/arch on the given
+// channel within limits. Clients on a channel other than stable are offered
+// stable releases too when they are newer. It returns ErrNoUpdateAvailable if
+// there are no assets on the channel or limits leave them all out.
+func (g *ReleaseManager) getProductUpdate(os string, arch string, channel string, limits *updateLimits) (asset *Asset, err error) {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
 
-	if g.latestAssetsMap == nil {
-		return nil, fmt.Errorf("No updates available.")
+	if g.lastRefresh.IsZero() && g.countAssets() == 0 {
+		return nil, ErrNotReady
 	}
 
-	if g.latestAssetsMap[os] == nil {
-		return nil, fmt.Errorf("No such OS.")
+	if g.latestAssetsMap[os] == nil || g.latestAssetsMap[os][arch] == nil {
+		return nil, ErrUnsupportedPlatform
 	}
 
-	if g.latestAssetsMap[os][arch] == nil {
-		return nil, fmt.Errorf("No such Arch.")
+	asset = g.latestAssetsMap[os][arch][stableChannel]
+	if channel != stableChannel {
+		if a := g.latestAssetsMap[os][arch][channel]; a != nil {
+			if asset == nil || a.v.GT(asset.v) {
+				asset = a
+			}
+		}
 	}
 
-	return g.latestAssetsMap[os][arch], nil
+	if asset != nil && !limits.allows(asset) {
+		// Held back, look for the newest version allowed.
+		asset = nil
+		for _, a := range g.updateAssetsMap[os][arch] {
+			if a.channel != stableChannel && a.channel != channel {
+				continue
+			}
+			if limits.allows(a) && (asset == nil || a.v.GT(asset.v)) {
+				asset = a
+			}
+		}
+		if asset == nil {
+			logger.Info("No compatible update", "os", os, "arch", arch, "channel", channel, "os_version", limits.osVersion.String())
+			return nil, ErrNoUpdateAvailable
+		}
+	}
+
+	if asset == nil {
+		// Nothing on the client's channel for its platform.
+		return nil, ErrNoUpdateAvailable
+	}
+
+	return asset, nil
 }
 
-func (g *ReleaseManager) lookupAssetWithChecksum(os string, arch string, checksum string) (asset *Asset, err error) {
+// rolloutPercent returns the percentage of clients asset is offered to now.
+// Ramped rollouts never go back below a percentage already applied, so that
+// clients offered a version keep being offered it.
+func (g *ReleaseManager) rolloutPercent(asset *Asset) int {
+	if asset.ramp == nil {
+		return asset.rollout
+	}
+	percent := asset.ramp.percent(time.Now())
+
+	g.rampMu.Lock()
+	defer g.rampMu.Unlock()
+
+	key := asset.v.String()
+	if peak := g.rampPeaks[key]; percent < peak {
+		return peak
+	}
+	if g.rampPeaks == nil {
+		g.rampPeaks = make(map[string]int)
+	}
+	g.rampPeaks[key] = percent
+	return percent
+}
+
+// forcedVersion returns the version the client must be offered, if forcing
+// versions is allowed.
+func forcedVersion(p *args.Params) string {
+	if !allowForceVersion {
+		return ""
+	}
+	return p.Tags[forceVersionTag]
+}
+
+// isCanary tells whether the client asked for versions above maxVersion and
+// releases still baking.
+func isCanary(p *args.Params) bool {
+	canary, _ := strconv.ParseBool(p.Tags[canaryTag])
+	return canary
+}
+
+func (g *ReleaseManager) lookupAssetWithChecksum(os string, arch string, algorithm args.ChecksumAlgorithm, checksum string) (asset *Asset, err error) {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
 
@@ -233,7 +635,7 @@ func (g *ReleaseManager) lookupAssetWithChecksum(os string, arch string, checksu
 	}
 
 	for _, a := range g.updateAssetsMap[os][arch] {
-		if a.Checksum == checksum {
+		if a.checksums[algorithm] == checksum {
 			return a, nil
 		}
 	}
@@ -241,31 +643,150 @@ func (g *ReleaseManager) lookupAssetWithChecksum(os string, arch string, checksu
 	return nil, fmt.Errorf("Could not find a matching checksum in assets list.")
 }
 
-func (g *ReleaseManager) pushAsset(os string, arch string, asset *Asset) (err error) {
-	g.mu.Lock()
-	defer g.mu.Unlock()
+// lookupAssetWithVersion returns the asset of the given version, or nil if
+// there is none.
+func (g *ReleaseManager) lookupAssetWithVersion(os string, arch string, version string) *Asset {
+	v, err := semver.Parse(version)
+	if err != nil {
+		return nil
+	}
 
-	version := asset.v
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 
-	asset.OS = os
-	asset.Arch = arch
+	return g.knownAsset(os, arch, v.String())
+}
 
-	if version.EQ(emptyVersion) {
+// fetchAssets fetches assets with up to assetWorkers workers, and returns the
+// error fetching each of them.
+func (g *ReleaseManager) fetchAssets(assets []*Asset) []error {
+	errs := make([]error, len(assets))
+	workers := assetWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i := range assets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			errs[i] = g.fetchAsset(assets[i])
+		}(i)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// fetchAsset downloads, checksums and signs asset, unless it is known
+// already.
+func (g *ReleaseManager) fetchAsset(asset *Asset) (err error) {
+	if asset.v.EQ(emptyVersion) {
 		return fmt.Errorf("Missing asset version.")
 	}
 
-	var localfile string
-	if localfile, err = downloadAsset(asset.URL, g.assetDir); err != nil {
-		return err
+	g.mu.RLock()
+	known := g.knownAsset(asset.OS, asset.Arch, asset.v.String())
+	signers := g.signers
+	g.mu.RUnlock()
+
+	if known != nil && known.URL == asset.URL && fileExists(known.LocalFile) {
+		// Already downloaded and signed, possibly loaded from the cache.
+		asset.LocalFile = known.LocalFile
+		asset.checksums = known.checksums
+		asset.Checksum = known.Checksum
+		asset.Signature = known.Signature
+		asset.signatures = known.signatures
+	} else {
+		digest := asset.digest
+		if digest == "" && asset.digestURL != "" {
+			if digest, err = fetchDigest(context.Background(), asset.digestURL); err != nil {
+				return err
+			}
+		}
+		var localfile string
+		if localfile, err = downloadAsset(context.Background(), asset.URL, g.assetDir, asset.size, digest); err != nil {
+			return err
+		}
+		asset.LocalFile = localfile
+
+		if asset.checksums, err = checksumsForFile(localfile); err != nil {
+			return err
+		}
+		asset.Checksum = asset.checksums[args.CHECKSUM_SHA256]
+
+		if asset.Signature, asset.signatures, err = signaturesForFile(localfile, signers); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SignResponse signs an update response body with the first signing key. It
+// returns the signature and the ID of the key.
+func (g *ReleaseManager) SignResponse(body []byte) (signature string, keyID string, err error) {
+	g.mu.RLock()
+	signers := g.signers
+	g.mu.RUnlock()
+
+	if len(signers) == 0 {
+		return "", "", fmt.Errorf("No signing key.")
+	}
+	if keyID, err = verify.KeyID(signers[0].Public()); err != nil {
+		return "", "", err
+	}
+	if signature, err = signatureForBytes(body, signers[0]); err != nil {
+		return "", "", err
 	}
+	return signature, keyID, nil
+}
 
-	if asset.Checksum, _, err = checksumForFile(localfile); err != nil {
-		return err
+// replaceAssets makes assets the only ones available, in order. Assets of
+// releases deleted, yanked or turned into pre-releases since the last refresh
+// are no longer offered.
+func (g *ReleaseManager) replaceAssets(assets []*Asset) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	previous := g.updateAssetsMap
+	g.updateAssetsMap = make(map[string]map[string]map[string]*Asset)
+	g.latestAssetsMap = make(map[string]map[string]map[string]*Asset)
+	for _, asset := range assets {
+		g.storeAsset(asset.OS, asset.Arch, asset)
+		logger.Info("Pushed asset", "name", asset.Name, "os", asset.OS, "arch", asset.Arch, "version", asset.v.String())
 	}
+	knownAssets.WithLabelValues(g.owner + "/" + g.repo).Set(float64(g.countAssets()))
 
-	if asset.Signature, err = signatureForFile(localfile, g.privKey); err != nil {
-		return err
+	for os := range previous {
+		for arch := range previous[os] {
+			for version, asset := range previous[os][arch] {
+				if g.knownAsset(os, arch, version) == nil {
+					logger.Info("Removed asset no longer released", "name", asset.Name, "os", os, "arch", arch, "version", version)
+				}
+			}
+		}
 	}
+}
+
+// knownAsset returns the asset known for os/arch/version, if any. The caller
+// must hold g.mu.
+func (g *ReleaseManager) knownAsset(os string, arch string, version string) *Asset {
+	if g.updateAssetsMap[os] == nil || g.updateAssetsMap[os][arch] == nil {
+		return nil
+	}
+	return g.updateAssetsMap[os][arch][version]
+}
+
+// storeAsset adds an asset to the maps. The caller must hold g.mu.
+func (g *ReleaseManager) storeAsset(os string, arch string, asset *Asset) {
+	version := asset.v
 
 	// Pushing version.
 	if g.updateAssetsMap[os] == nil {
@@ -275,73 +796,436 @@ func (g *ReleaseManager) pushAsset(os string, arch string, asset *Asset) (err er
 		g.updateAssetsMap[os][arch] = make(map[string]*Asset)
 	}
 	g.updateAssetsMap[os][arch][version.String()] = asset
+	knownAssets.WithLabelValues(g.owner + "/" + g.repo).Set(float64(g.countAssets()))
 
 	// Setting latest version.
+	channel := asset.channel
 	if g.latestAssetsMap[os] == nil {
-		g.latestAssetsMap[os] = make(map[string]*Asset)
+		g.latestAssetsMap[os] = make(map[string]map[string]*Asset)
 	}
 	if g.latestAssetsMap[os][arch] == nil {
-		g.latestAssetsMap[os][arch] = asset
+		g.latestAssetsMap[os][arch] = make(map[string]*Asset)
+	}
+	if g.latestAssetsMap[os][arch][channel] == nil {
+		g.latestAssetsMap[os][arch][channel] = asset
 	} else {
-		// Compare against already set version
-		if asset.v.GT(g.latestAssetsMap[os][arch].v) {
-			g.latestAssetsMap[os][arch] = asset
+		// Compare against already set version, a pushed again version
+		// replaces the previous one.
+		if !asset.v.LT(g.latestAssetsMap[os][arch][channel].v) {
+			g.latestAssetsMap[os][arch][channel] = asset
 		}
 	}
+}
 
-	return nil
+// AssetSummary describes a known asset.
+type AssetSummary struct {
+	Name      string `json:"name"`
+	Checksum  string `json:"checksum"`
+	Signature string `json:"signature"`
+	URL       string `json:"url"`
 }
 
-// CheckForUpdate receives a *Params message and emits a *Result. If both res
-// and err are nil it means no update is available.
-func (g *ReleaseManager) CheckForUpdate(p *args.Params) (res *args.Result, err error) {
-	log.Printf("%v", p)
-	// Keep for the future.
-	if p.Version < 1 {
-		p.Version = 1
+// ListAssets returns a snapshot of all known assets, indexed by os, arch and
+// version.
+func (g *ReleaseManager) ListAssets() map[string]map[string]map[string]AssetSummary {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	list := make(map[string]map[string]map[string]AssetSummary)
+	for os := range g.updateAssetsMap {
+		list[os] = make(map[string]map[string]AssetSummary)
+		for arch := range g.updateAssetsMap[os] {
+			list[os][arch] = make(map[string]AssetSummary)
+			for version, a := range g.updateAssetsMap[os][arch] {
+				list[os][arch][version] = AssetSummary{
+					Name:      a.Name,
+					Checksum:  a.Checksum,
+					Signature: a.Signature,
+					URL:       a.URL,
+				}
+			}
+		}
 	}
+	return list
+}
+
+// VersionSummary describes a version available for an OS and architecture.
+type VersionSummary struct {
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+	URL      string `json:"url"`
+}
+
+// ListVersions returns the versions available for os and arch, newest first.
+// Versions held back by maxVersion are left out.
+func (g *ReleaseManager) ListVersions(os string, arch string) []VersionSummary {
+	g.mu.RLock()
+	assets := make([]*Asset, 0, len(g.updateAssetsMap[os][arch]))
+	for _, a := range g.updateAssetsMap[os][arch] {
+		if maxVersion.Equals(emptyVersion) || a.v.LTE(maxVersion) {
+			assets = append(assets, a)
+		}
+	}
+	g.mu.RUnlock()
+
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].v.GT(assets[j].v)
+	})
+
+	list := make([]VersionSummary, len(assets))
+	for i, a := range assets {
+		list[i] = VersionSummary{
+			Version:  a.v.String(),
+			Checksum: a.Checksum,
+			URL:      a.URL,
+		}
+	}
+	return list
+}
+
+// LatestVersion describes the latest version on a channel for an OS and
+// architecture.
+type LatestVersion struct {
+	Version   string `json:"version"`
+	Channel   string `json:"channel"`
+	Checksum  string `json:"checksum"`
+	Signature string `json:"signature"`
+	URL       string `json:"url"`
+}
+
+// Latest returns the latest version on channel for os and arch, or nil if
+// there is none. Versions held back by maxVersion are left out.
+func (g *ReleaseManager) Latest(os string, arch string, channel string) *LatestVersion {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	asset := g.latestAssetsMap[os][arch][channel]
+	if asset != nil && !maxVersion.Equals(emptyVersion) && asset.v.GT(maxVersion) {
+		asset = nil
+		for _, a := range g.updateAssetsMap[os][arch] {
+			if a.channel == channel && a.v.LTE(maxVersion) && (asset == nil || a.v.GT(asset.v)) {
+				asset = a
+			}
+		}
+	}
+	if asset == nil {
+		return nil
+	}
+	return &LatestVersion{
+		Version:   asset.v.String(),
+		Channel:   asset.channel,
+		Checksum:  asset.Checksum,
+		Signature: asset.Signature,
+		URL:       asset.URL,
+	}
+}
+
+// Health reports the state of the assets of the repository.
+type Health struct {
+	Assets       int       `json:"assets"`
+	FailedAssets int       `json:"failed_assets"`
+	LastRefresh  time.Time `json:"last_refresh"`
+}
+
+// Health returns the state of the assets as of the last refresh.
+func (g *ReleaseManager) Health() Health {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return Health{
+		Assets:       g.countAssets(),
+		FailedAssets: g.failedAssets,
+		LastRefresh:  g.lastRefresh,
+	}
+}
+
+// Repo returns the owner and name of the repository.
+func (g *ReleaseManager) Repo() string {
+	return g.owner + "/" + g.repo
+}
+
+// Channels returns the channels there are assets on, sorted.
+func (g *ReleaseManager) Channels() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	channels := []string{}
+	for os := range g.latestAssetsMap {
+		for arch := range g.latestAssetsMap[os] {
+			for channel := range g.latestAssetsMap[os][arch] {
+				if !seen[channel] {
+					seen[channel] = true
+					channels = append(channels, channel)
+				}
+			}
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Platform is an os/arch pair.
+type Platform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+// Platforms returns the platforms there are assets for, sorted.
+func (g *ReleaseManager) Platforms() []Platform {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	platforms := []Platform{}
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			if len(g.updateAssetsMap[os][arch]) > 0 {
+				platforms = append(platforms, Platform{OS: os, Arch: arch})
+			}
+		}
+	}
+	sort.Slice(platforms, func(i, j int) bool {
+		if platforms[i].OS != platforms[j].OS {
+			return platforms[i].OS < platforms[j].OS
+		}
+		return platforms[i].Arch < platforms[j].Arch
+	})
+	return platforms
+}
+
+// LocalFiles returns the set of local files of all known assets.
+func (g *ReleaseManager) LocalFiles() map[string]bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	files := make(map[string]bool)
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			for _, a := range g.updateAssetsMap[os][arch] {
+				files[a.LocalFile] = true
+			}
+		}
+	}
+	return files
+}
+
+// countAssets returns the number of known os/arch/version assets. The caller
+// must hold g.mu.
+func (g *ReleaseManager) countAssets() (n int) {
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			n += len(g.updateAssetsMap[os][arch])
+		}
+	}
+	return n
+}
+
+// Pregenerate generates the patches from every known version to the latest
+// one of each channel, so that clients find them ready. It returns how many
+// patches were generated or found, and the first error met.
+func (g *ReleaseManager) Pregenerate(ctx context.Context) (n int, err error) {
+	type pair struct {
+		os, arch string
+		from, to *Asset
+	}
+
+	var pairs []pair
+	seen := make(map[string]bool)
+	g.mu.RLock()
+	for os := range g.latestAssetsMap {
+		for arch := range g.latestAssetsMap[os] {
+			for _, latest := range g.latestAssetsMap[os][arch] {
+				for _, a := range g.updateAssetsMap[os][arch] {
+					if key := a.Checksum + "|" + latest.Checksum; a.v.LT(latest.v) && !seen[key] {
+						seen[key] = true
+						pairs = append(pairs, pair{os: os, arch: arch, from: a, to: latest})
+					}
+				}
+			}
+		}
+	}
+	g.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, pr := range pairs {
+		wg.Add(1)
+		go func(pr pair) {
+			defer wg.Done()
+			// Generations are bounded by the patch slots.
+			for _, patcher := range patchersOf(pr.os) {
+				patch, e := generatePatchFor(ctx, patcher, pr.from, pr.to, g.assetDir, g.patchDir)
+				if e == nil && verifyPatches {
+					e = verifyPatch(patch, pr.to.Checksum)
+				}
+				mu.Lock()
+				if e != nil {
+					logger.Error("Could not pregenerate patch", "os", pr.os, "arch", pr.arch, "from_version", pr.from.v.String(), "to_version", pr.to.v.String(), "patch_type", patcher.Type(), "error", e)
+					if err == nil {
+						err = e
+					}
+				} else {
+					n++
+				}
+				mu.Unlock()
+			}
+		}(pr)
+	}
+	wg.Wait()
+
+	return n, err
+}
+
+// maxChannels is the number of channels a client may ask to try at most.
+const maxChannels = 8
+
+// CheckForUpdate receives a *Params message and emits a *Result. If both res
+// and err are nil it means no update is available. Patch generation is
+// abandoned when ctx is done.
+func (g *ReleaseManager) CheckForUpdate(ctx context.Context, p *args.Params) (res *args.Result, err error) {
+	defer func() {
+		observeResult(res, err)
+	}()
 
 	// p must not be nil.
 	if p == nil {
-		return nil, fmt.Errorf("Expecting params")
+		return nil, newCheckError(args.ERROR_MISSING_PARAMS, "Expecting params")
 	}
 
-	if p.Tags != nil {
-		// Compatibility with go-check.
-		if p.Tags["os"] != "" {
-			p.OS = p.Tags["os"]
+	if len(p.Channels) > 0 {
+		return g.checkChannels(ctx, p)
+	}
+	return g.checkForUpdate(ctx, p)
+}
+
+// checkChannels checks for an update on each of the channels p asks for in
+// turn, returning the first one found.
+func (g *ReleaseManager) checkChannels(ctx context.Context, p *args.Params) (*args.Result, error) {
+	if len(p.Channels) > maxChannels {
+		return nil, newCheckError(args.ERROR_BAD_REQUEST, "Too many channels, expecting %d at most", maxChannels)
+	}
+	for _, channel := range p.Channels {
+		q := *p
+		q.Channel = channel
+		q.Channels = nil
+		res, err := g.checkForUpdate(ctx, &q)
+		if err == ErrNoUpdateAvailable {
+			continue
 		}
-		if p.Tags["arch"] != "" {
-			p.Arch = p.Tags["arch"]
+		if err != nil {
+			return nil, err
 		}
+		res.Channel = q.Channel
+		return res, nil
+	}
+	return nil, ErrNoUpdateAvailable
+}
+
+// checkForUpdate checks for an update on the channel of p.
+func (g *ReleaseManager) checkForUpdate(ctx context.Context, p *args.Params) (*args.Result, error) {
+	var err error
+
+	// Keep for the future.
+	if p.Version < 1 {
+		p.Version = 1
 	}
 
+	normalizeParams(p)
+
+	logger.Info("Checking for update", "os", p.OS, "arch", p.Arch, "from_version", p.AppVersion, "channel", p.Channel)
+
 	appVersion, err := semver.Parse(p.AppVersion)
 	if err != nil {
-		return nil, fmt.Errorf("Bad version string: %v", err)
+		return nil, newCheckError(args.ERROR_BAD_VERSION, "Bad version string: %v", err)
 	}
 
-	if p.Checksum == "" {
-		return nil, fmt.Errorf("Checksum must not be nil")
+	if p.Checksum == "" && p.FromVersion == "" {
+		return nil, newCheckError(args.ERROR_MISSING_CHECKSUM, "Checksum must not be nil")
+	}
+
+	if p.ChecksumAlgorithm != args.CHECKSUM_SHA256 && p.ChecksumAlgorithm != args.CHECKSUM_SHA512 {
+		return nil, newCheckError(args.ERROR_BAD_CHECKSUM_ALGO, "Unsupported checksum algorithm: %q", p.ChecksumAlgorithm)
 	}
 
 	if p.OS == "" {
-		return nil, fmt.Errorf("OS is required")
+		return nil, newCheckError(args.ERROR_MISSING_OS, "OS is required")
 	}
 
 	if p.Arch == "" {
-		return nil, fmt.Errorf("Arch is required")
+		return nil, newCheckError(args.ERROR_MISSING_ARCH, "Arch is required")
+	}
+
+	if !contains(knownOSes, p.OS) {
+		return nil, newCheckError(args.ERROR_BAD_OS, "Unknown OS %q, expecting one of: %s", p.OS, strings.Join(knownOSes, ", "))
+	}
+
+	if !contains(knownArchs, p.Arch) {
+		return nil, newCheckError(args.ERROR_BAD_ARCH, "Unknown arch %q, expecting one of: %s", p.Arch, strings.Join(knownArchs, ", "))
 	}
 
 	// Looking if there is a newer version for the os/arch.
 	var update *Asset
-	if update, err = g.getProductUpdate(p.OS, p.Arch); err != nil {
-		return nil, fmt.Errorf("Could not lookup for updates: %s", err)
+	limits := &updateLimits{ceiling: maxVersion, major: -1}
+	if isCanary(p) {
+		limits.ceiling = emptyVersion
+	} else if bakePeriod > 0 {
+		limits.bakedBefore = time.Now().Add(-bakePeriod)
+	}
+	if updatePolicy == policySameMajor {
+		limits.major = int64(appVersion.Major)
+	}
+	if p.OSVersion != "" {
+		if limits.osVersion, err = semver.ParseTolerant(p.OSVersion); err != nil {
+			return nil, newCheckError(args.ERROR_BAD_VERSION, "Bad OS version string: %v", err)
+		}
+	}
+	// Clients left out of the rollout of the newest release are offered the
+	// newest one they are part of the rollout of.
+	limits.rollout = func(a *Asset) bool {
+		return inRollout(p.UserId, a.v, g.rolloutPercent(a))
+	}
+	forced := forcedVersion(p)
+	if forced != "" {
+		if update = g.lookupAssetWithVersion(p.OS, p.Arch, forced); update == nil {
+			return nil, newCheckError(args.ERROR_NO_RELEASE, "No asset for forced version %q", forced)
+		}
+		logger.Warn("Offering forced version", "os", p.OS, "arch", p.Arch, "from_version", p.AppVersion, "to_version", update.v.String(), "user_id", p.UserId)
+	} else if update, err = g.getProductUpdate(p.OS, p.Arch, p.Channel, limits); err != nil {
+		if err == ErrNotReady || err == ErrUnsupportedPlatform || err == ErrNoUpdateAvailable {
+			return nil, err
+		}
+		return nil, newCheckError(args.ERROR_NO_RELEASE, "Could not lookup for updates: %s", err)
 	}
 
-	// Looking for the asset thay matches the current app checksum.
+	if noPatches {
+		// There is nothing to patch, the app version tells whether the
+		// update is newer.
+		if forced == "" && update.v.LTE(appVersion) {
+			if update.v.LT(appVersion) {
+				logger.Warn("Prevented downgrade", "os", p.OS, "arch", p.Arch, "from_version", p.AppVersion, "to_version", update.v.String())
+			}
+			return nil, ErrNoUpdateAvailable
+		}
+		return withNotes(fullResult(update, p, initiativeFor(update, appVersion)), update, p), nil
+	}
+
+	// Looking for the asset of the version the client says it runs, or else
+	// the asset thay matches the current app checksum.
 	var current *Asset
-	if current, err = g.lookupAssetWithChecksum(p.OS, p.Arch, p.Checksum); err != nil {
+	_, span := tracer.Start(ctx, "lookup current asset")
+	matchedBy := "version"
+	if p.FromVersion != "" {
+		current = g.lookupAssetWithVersion(p.OS, p.Arch, p.FromVersion)
+	}
+	if current == nil {
+		matchedBy = "checksum"
+		current, err = g.lookupAssetWithChecksum(p.OS, p.Arch, p.ChecksumAlgorithm, p.Checksum)
+	}
+	if err == nil {
+		span.SetAttributes(attribute.String("matched_by", matchedBy))
+	}
+	endSpan(span, err)
+	if err != nil {
 		// No such asset with the given checksum, nothing to compare.
 		// r := &args.Result{
 		//	Initiative: args.INITIATIVE_AUTO,
@@ -353,54 +1237,407 @@ func (g *ReleaseManager) CheckForUpdate(p *args.Params) (res *args.Result, err e
 		// }
 
 		// return r, nil
-		log.Printf("warning: checksum not found in released versions")
+		observeCurrentLookup("miss", p)
+		logger.Warn("Checksum not found in released versions", "os", p.OS, "arch", p.Arch, "from_version", p.AppVersion, "checksum", p.Checksum, "checksum_algorithm", p.ChecksumAlgorithm)
+		if forced != "" {
+			return withNotes(fullResult(update, p, initiativeFor(update, appVersion)), update, p), nil
+		}
 		return nil, ErrNoUpdateAvailable
 	}
-
-	// No update available.
-	if update.v.LTE(appVersion) {
+	observeCurrentLookup(matchedBy, p)
+	logger.Debug("Matched current asset", "name", current.Name, "version", current.v.String(), "by", matchedBy, "os", p.OS, "arch", p.Arch)
+
+	// No update available. Whatever the latest assets are, e.g. after a newer
+	// release was yanked, clients are never offered their own version or an
+	// older one, unless testing with a forced version.
+	if forced == "" && (update.v.LTE(appVersion) || update.v.LTE(current.v)) {
+		if update.v.LT(appVersion) || update.v.LT(current.v) {
+			logger.Warn("Prevented downgrade", "os", p.OS, "arch", p.Arch, "from_version", p.AppVersion, "current_version", current.v.String(), "to_version", update.v.String())
+		}
 		return nil, ErrNoUpdateAvailable
 	}
 
+	initiative := initiativeFor(update, appVersion)
+
+	// The client asks again for the patch when it is about to update.
+	if p.MetadataOnly {
+		return withNotes(fullResult(update, p, initiative), update, p), nil
+	}
+
 	// Generate a binary diff of the two assets.
 	var patch *Patch
-	log.Printf("Generating patch")
-	if patch, err = generatePatch(current.URL, update.URL, g.assetDir, g.patchDir); err != nil {
-		return nil, fmt.Errorf("Unable to generate patch: %q", err)
+	start := time.Now()
+	if patch, err = generatePatchFor(ctx, patcherFor(p), current, update, g.assetDir, g.patchDir); err != nil {
+		if err == ErrPatchBusy {
+			// Let the client download the whole update instead.
+			logger.Warn("Patch generation busy, offering full download", "os", p.OS, "arch", p.Arch, "from_version", current.v.String(), "to_version", update.v.String())
+			return withNotes(fullResult(update, p, initiative), update, p), nil
+		}
+		if ctx.Err() != nil {
+			// The client is gone.
+			return nil, newCheckError(args.ERROR_PATCH_FAILED, "Unable to generate patch: %q", err)
+		}
+		// The client can still update, only without saving bandwidth.
+		patchErrorsTotal.Inc()
+		logger.Error("Patch generation failed, offering full download", "os", p.OS, "arch", p.Arch, "from_version", current.v.String(), "to_version", update.v.String(), "error", err)
+		return withNotes(fullResult(update, p, initiative), update, p), nil
+	}
+
+	if verifyPatches {
+		if err = verifyPatch(patch, update.Checksum); err != nil {
+			patchErrorsTotal.Inc()
+			logger.Error("Patch does not reproduce update, offering full download", "os", p.OS, "arch", p.Arch, "from_version", current.v.String(), "to_version", update.v.String(), "error", err)
+			return withNotes(fullResult(update, p, initiative), update, p), nil
+		}
+	}
+	logger.Info("Generated patch", "os", p.OS, "arch", p.Arch, "from_version", current.v.String(), "to_version", update.v.String(), "patch_type", patch.patcher.Type(), "duration", time.Since(start))
+
+	patchFile, patchType, ok := offeredPatch(ctx, patch, p)
+	if !ok {
+		logger.Warn("No patch the client supports, offering full download", "os", p.OS, "arch", p.Arch, "from_version", current.v.String(), "to_version", update.v.String())
+		return withNotes(fullResult(update, p, initiative), update, p), nil
+	}
+
+	// A patch almost as large as the update is not worth the risk of
+	// applying it.
+	if patchSize, updateSize := fileSize(patchFile), fileSize(update.LocalFile); maxPatchRatio > 0 && patchSize > 0 && updateSize > 0 {
+		ratio := float64(patchSize) / float64(updateSize)
+		if ratio > maxPatchRatio {
+			logger.Info("Patch too large, offering full download", "os", p.OS, "arch", p.Arch, "from_version", current.v.String(), "to_version", update.v.String(), "ratio", ratio, "max_ratio", maxPatchRatio)
+			patchSizeDecisionsTotal.WithLabelValues("full").Inc()
+			return withNotes(fullResult(update, p, initiative), update, p), nil
+		}
+		logger.Debug("Patch size accepted", "os", p.OS, "arch", p.Arch, "from_version", current.v.String(), "to_version", update.v.String(), "ratio", ratio, "max_ratio", maxPatchRatio)
+		patchSizeDecisionsTotal.WithLabelValues("patch").Inc()
 	}
 
 	// Generate result.
 	r := &args.Result{
-		Initiative: args.INITIATIVE_AUTO,
-		URL:        update.URL,
-		PatchURL:   patch.File,
-		PatchType:  args.PATCHTYPE_BSDIFF,
-		Version:    update.v.String(),
-		Checksum:   update.Checksum,
-		Signature:  update.Signature,
+		Initiative:        initiative,
+		URL:               update.URL,
+		PatchURL:          patchURL(path.Base(patchFile)),
+		PatchType:         patchType,
+		Version:           update.v.String(),
+		Checksum:          update.checksums[p.ChecksumAlgorithm],
+		ChecksumAlgorithm: p.ChecksumAlgorithm,
+		Signature:         update.Signature,
+		Signatures:        update.signatures,
+		Mandatory:         update.mandatory,
+	}
+
+	if p.ChainedPatches {
+		if chain, size := g.patchChain(ctx, current, update, p); chain != nil && size < fileSize(patchFile) {
+			r.PatchChain = chain
+		}
+	}
+
+	return withNotes(r, update, p), nil
+}
+
+// normalizeParams applies the tags of go-check clients to p and fills in the
+// defaults of its channel and checksum algorithm. The update handler does it
+// before anything looks at p, for coalesced checks only change the params of
+// the first one.
+func normalizeParams(p *args.Params) {
+	if p.Tags != nil {
+		// Compatibility with go-check.
+		if p.Tags["os"] != "" {
+			p.OS = p.Tags["os"]
+		}
+		if p.Tags["arch"] != "" {
+			p.Arch = p.Tags["arch"]
+		}
+		if p.Channel == "" {
+			p.Channel = p.Tags["channel"]
+		}
 	}
 
-	return r, nil
+	if p.Channel == "" {
+		p.Channel = stableChannel
+	}
+
+	if p.ChecksumAlgorithm == "" {
+		p.ChecksumAlgorithm = args.CHECKSUM_SHA256
+	}
+}
+
+// offeredPatch returns the patch file to offer the client and its type: a
+// zstd compressed bsdiff patch if the client supports it and it is smaller,
+// or if the client does not support plain bsdiff patches. ok is false if
+// there is no patch the client supports.
+func offeredPatch(ctx context.Context, patch *Patch, p *args.Params) (file string, patchType args.PatchType, ok bool) {
+	if patch.patcher.Type() != args.PATCHTYPE_BSDIFF {
+		return patch.File, patch.patcher.Type(), true
+	}
+	bsdiff := supportsPatchType(p, args.PATCHTYPE_BSDIFF)
+	if supportsPatchType(p, args.PATCHTYPE_BSDIFF_ZSTD) {
+		if zstdFile, err := zstdCompress(ctx, patch.File); err != nil {
+			logger.Warn("Could not compress patch", "file", patch.File, "error", err)
+		} else if !bsdiff || fileSize(zstdFile) < fileSize(patch.File) {
+			return zstdFile, args.PATCHTYPE_BSDIFF_ZSTD, true
+		}
+	}
+	if !bsdiff {
+		return "", args.PATCHTYPE_NONE, false
+	}
+	return patch.File, args.PATCHTYPE_BSDIFF, true
 }
 
-func getAssetInfo(s string) (*AssetInfo, error) {
-	matches := updateAssetRe.FindStringSubmatch(s)
-	if len(matches) >= 3 {
-		if matches[1] != OS.Windows && matches[1] != OS.Linux && matches[1] != OS.Darwin {
-			return nil, fmt.Errorf("Unknown OS: \"%s\".", matches[1])
+// patchChain generates patches from current to update through the versions
+// released in between, and returns them with their total size. It returns
+// nil if there are no such versions, too many of them or if a patch cannot
+// be generated.
+func (g *ReleaseManager) patchChain(ctx context.Context, current *Asset, update *Asset, p *args.Params) ([]args.ChainedPatch, int64) {
+	steps := g.intermediateAssets(current, update)
+	if len(steps) == 0 || maxPatchChain < 2 || len(steps)+1 > maxPatchChain {
+		return nil, 0
+	}
+	steps = append(steps, update)
+
+	var chain []args.ChainedPatch
+	var size int64
+	from := current
+	for _, to := range steps {
+		patch, err := generatePatchFor(ctx, patcherFor(p), from, to, g.assetDir, g.patchDir)
+		if err == nil && verifyPatches {
+			err = verifyPatch(patch, to.Checksum)
+		}
+		if err != nil {
+			logger.Warn("Could not generate chained patch, offering the direct patch", "os", p.OS, "arch", p.Arch, "from_version", from.v.String(), "to_version", to.v.String(), "error", err)
+			return nil, 0
+		}
+		patchFile, patchType, ok := offeredPatch(ctx, patch, p)
+		if !ok {
+			return nil, 0
 		}
-		if matches[2] != Arch.X64 && matches[2] != Arch.X86 && matches[2] != Arch.ARM {
-			return nil, fmt.Errorf("Unknown architecture \"%s\".", matches[2])
+		size += fileSize(patchFile)
+		chain = append(chain, args.ChainedPatch{
+			PatchURL:  patchURL(path.Base(patchFile)),
+			PatchType: patchType,
+			Version:   to.v.String(),
+			Checksum:  to.checksums[p.ChecksumAlgorithm],
+		})
+		from = to
+	}
+
+	return chain, size
+}
+
+// intermediateAssets returns the assets of the platform released between
+// from and to on the channel of to or the stable channel, oldest first.
+func (g *ReleaseManager) intermediateAssets(from *Asset, to *Asset) []*Asset {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var assets []*Asset
+	for _, a := range g.updateAssetsMap[to.OS][to.Arch] {
+		if a.channel != stableChannel && a.channel != to.channel {
+			continue
 		}
-		info := &AssetInfo{
-			OS:   matches[1],
-			Arch: matches[2],
+		if a.v.GT(from.v) && a.v.LT(to.v) {
+			assets = append(assets, a)
 		}
-		return info, nil
 	}
-	return nil, fmt.Errorf("Could not find asset info.")
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].v.LT(assets[j].v)
+	})
+	return assets
+}
+
+// patchURL tells where clients download the named patch from. Patches served
+// by this server have URLs relative to its public address.
+func patchURL(name string) string {
+	if isUnpublished(name) {
+		// Served from the patch directory.
+		return "patches/" + name
+	}
+	u, err := patchStorage.URL(name)
+	if err != nil {
+		logger.Warn("Could not get patch URL from storage", "name", name, "error", err)
+	}
+	if u != "" {
+		return u
+	}
+	return "patches/" + name
 }
 
-func isUpdateAsset(s string) bool {
-	return updateAssetRe.MatchString(s)
+// selectAssets picks one asset per platform and version among candidates,
+// the one whose name ends with the most preferred suffix of assetPreference.
+// Platforms with several equally preferred assets are skipped, rather than
+// served depending on the order assets are listed in.
+func selectAssets(candidates []*Asset) []*Asset {
+	var keys []string
+	best := make(map[string]*Asset)
+	ambiguous := make(map[string]bool)
+	for _, a := range candidates {
+		key := a.OS + "/" + a.Arch + "/" + a.v.String()
+		b, ok := best[key]
+		if !ok {
+			keys = append(keys, key)
+			best[key] = a
+			continue
+		}
+		switch ra, rb := assetRank(a.Name), assetRank(b.Name); {
+		case ra < rb:
+			best[key] = a
+			ambiguous[key] = false
+		case ra == rb:
+			ambiguous[key] = true
+		}
+	}
+
+	selected := make([]*Asset, 0, len(keys))
+	for _, key := range keys {
+		if ambiguous[key] {
+			logger.Error("Several update assets for the same platform, skipping them; see -asset-prefer", "platform", key)
+			continue
+		}
+		selected = append(selected, best[key])
+	}
+	return selected
+}
+
+// assetRank ranks an asset name by assetPreference, lower is preferred.
+func assetRank(name string) int {
+	for i, suffix := range assetPreference {
+		if strings.HasSuffix(name, suffix) {
+			return i
+		}
+	}
+	return len(assetPreference)
+}
+
+// parseVersion parses a release tag as a semantic version, allowing the
+// customary "v" prefix as in "v1.2.3".
+func parseVersion(tag string) (semver.Version, error) {
+	if strings.HasPrefix(tag, "v") || strings.HasPrefix(tag, "V") {
+		tag = tag[1:]
+	}
+	return semver.Parse(tag)
+}
+
+// addOSes adds the comma separated operating systems in list, e.g.
+// "freebsd,openbsd", to knownOSes. Names must be lowercase.
+func addOSes(list string) error {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("empty OS name")
+		}
+		if name != strings.ToLower(name) {
+			return fmt.Errorf("OS name %q is not lowercase", name)
+		}
+		if !contains(knownOSes, name) {
+			knownOSes = append(knownOSes, name)
+		}
+	}
+	assetClassifier = &regexpClassifier{re: defaultAssetRe()}
+	return nil
+}
+
+// minOSRe finds the minimum OS version in asset names, such as
+// update_darwin_arm64_minos11 or update_windows_amd64.minos-10.0.exe.
+var minOSRe = regexp.MustCompile(`[._-]minos-?(\d+(?:\.\d+){0,2})`)
+
+// minOSVersion returns the minimum OS version of the named asset, or an
+// empty version if it has none.
+func minOSVersion(name string) (semver.Version, error) {
+	matches := minOSRe.FindStringSubmatch(name)
+	if matches == nil {
+		return emptyVersion, nil
+	}
+	return semver.ParseTolerant(matches[1])
+}
+
+// initiativeFor tells how a client running appVersion should apply update.
+// Mandatory updates are always applied automatically.
+func initiativeFor(update *Asset, appVersion semver.Version) args.Initiative {
+	if !update.mandatory && appVersion.LT(minAutoVersion) {
+		return args.INITIATIVE_MANUAL
+	}
+	return args.INITIATIVE_AUTO
+}
+
+// fullResult generates a result offering the whole update without a patch.
+func fullResult(update *Asset, p *args.Params, initiative args.Initiative) *args.Result {
+	return &args.Result{
+		Initiative:        initiative,
+		URL:               update.URL,
+		PatchType:         args.PATCHTYPE_NONE,
+		Version:           update.v.String(),
+		Checksum:          update.checksums[p.ChecksumAlgorithm],
+		ChecksumAlgorithm: p.ChecksumAlgorithm,
+		Signature:         update.Signature,
+		Signatures:        update.signatures,
+		Mandatory:         update.mandatory,
+	}
+}
+
+// withNotes adds the release title and notes to the result if the client
+// asked for them.
+func withNotes(r *args.Result, update *Asset, p *args.Params) *args.Result {
+	if p.WithNotes {
+		r.Title = update.title
+		r.Notes = update.notes
+	}
+	return r
+}
+
+// supportsPatchType tells whether the client supports the patch type.
+// Clients that do not advertise any are assumed to support bsdiff.
+func supportsPatchType(p *args.Params, t args.PatchType) bool {
+	if len(p.PatchTypes) == 0 {
+		return t == args.PATCHTYPE_BSDIFF
+	}
+	for _, pt := range p.PatchTypes {
+		if pt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// channelOf returns the release channel of a version, that is the first
+// pre-release identifier (e.g. "beta" for 1.2.0-beta.1) or stable if there is
+// none.
+func channelOf(v semver.Version) string {
+	if len(v.Pre) == 0 {
+		return stableChannel
+	}
+	return v.Pre[0].String()
+}
+
+// alternation builds a regexp alternation of the given names. Longer names
+// come first so that "arm64" is not matched as "arm".
+func alternation(names []string) string {
+	sorted := make([]string, len(names))
+	copy(sorted, names)
+	sort.Sort(sort.Reverse(byLength(sorted)))
+	for i := range sorted {
+		sorted[i] = regexp.QuoteMeta(sorted[i])
+	}
+	return strings.Join(sorted, "|")
+}
+
+type byLength []string
+
+func (a byLength) Len() int {
+	return len(a)
+}
+
+func (a byLength) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a byLength) Less(i, j int) bool {
+	return len(a[i]) < len(a[j])
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+func TestCheckForUpdateNilParams(t *testing.T) {
+	repo := newTestRepo(t)
+
+	for name, check := range map[string]func(context.Context, *args.Params) (*args.Result, error){
+		"manager":  repo.manager.CheckForUpdate,
+		"registry": apps.CheckForUpdate,
+	} {
+		res, err := check(context.Background(), nil)
+		if res != nil || errorCode(err) != args.ERROR_MISSING_PARAMS {
+			t.Errorf("%s: CheckForUpdate(nil) = %v, %v, want a %s error", name, res, err, args.ERROR_MISSING_PARAMS)
+		}
+	}
+}
+
+func TestGetReleasesSkipsInvalidTags(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.source.set(
+		repo.release(3, "latest", "linux_amd64"),
+		repo.release(2, "v1.1.0", "linux_amd64"),
+		repo.release(1, "1.0.0", "linux_amd64"),
+	)
+
+	releases, err := repo.manager.getReleases(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []string
+	for _, rel := range releases {
+		versions = append(versions, rel.Version.String())
+	}
+	if want := []string{"1.1.0", "1.0.0"}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("versions = %v, want %v", versions, want)
+	}
+}
+
+func TestSelectAssetsSamePlatform(t *testing.T) {
+	saved := assetPreference
+	t.Cleanup(func() { assetPreference = saved })
+
+	v := semver.MustParse("1.0.0")
+	archive := &Asset{Name: "update_linux_amd64.tar.gz", v: v, AssetInfo: AssetInfo{OS: "linux", Arch: "amd64"}}
+	binary := &Asset{Name: "update_linux_amd64", v: v, AssetInfo: AssetInfo{OS: "linux", Arch: "amd64"}}
+
+	tests := []struct {
+		preference []string
+		want       *Asset
+	}{
+		{[]string{".tar.gz"}, archive},
+		{[]string{"_amd64"}, binary},
+		{nil, nil},
+	}
+
+	for _, tt := range tests {
+		assetPreference = tt.preference
+		// The order assets are listed in does not matter.
+		for _, candidates := range [][]*Asset{{archive, binary}, {binary, archive}} {
+			selected := selectAssets(candidates)
+			switch {
+			case tt.want == nil && len(selected) != 0:
+				t.Errorf("preferring %q: selected %s, want none", tt.preference, selected[0].Name)
+			case tt.want != nil && (len(selected) != 1 || selected[0] != tt.want):
+				t.Errorf("preferring %q: selected %d assets, want %s", tt.preference, len(selected), tt.want.Name)
+			}
+		}
+	}
+}
+
+func TestCheckForUpdatePlatforms(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.publish(t,
+		repo.release(2, "1.1.0", "linux_amd64", "windows_386"),
+		repo.release(1, "1.0.0", "linux_amd64", "windows_386"),
+	)
+
+	tests := []struct {
+		os   string
+		arch string
+		err  error
+		code args.ErrorCode
+	}{
+		{os: "linux", arch: "amd64"},
+		{os: "windows", arch: "386"},
+		{os: "darwin", arch: "arm64", err: ErrUnsupportedPlatform},
+		{os: "linux", arch: "386", err: ErrUnsupportedPlatform},
+		{os: "win", arch: "amd64", code: args.ERROR_BAD_OS},
+		{os: "Linux", arch: "amd64", code: args.ERROR_BAD_OS},
+		{os: "linux", arch: "x64", code: args.ERROR_BAD_ARCH},
+	}
+
+	for _, tt := range tests {
+		p := &args.Params{AppVersion: "1.0.0", OS: tt.os, Arch: tt.arch, Checksum: testChecksum(testBinary(tt.os+"_"+tt.arch, "1.0.0")), MetadataOnly: true}
+		res, err := repo.manager.CheckForUpdate(context.Background(), p)
+		switch {
+		case tt.code != "":
+			if errorCode(err) != tt.code {
+				t.Errorf("%s/%s: error %v, want a %s error", tt.os, tt.arch, err, tt.code)
+			}
+		case err != tt.err:
+			t.Errorf("%s/%s: error %v, want %v", tt.os, tt.arch, err, tt.err)
+		case err == nil && res.Version != "1.1.0":
+			t.Errorf("%s/%s: offered %s, want 1.1.0", tt.os, tt.arch, res.Version)
+		}
+	}
+}
+
+func TestCheckForUpdateYankedRelease(t *testing.T) {
+	repo := newTestRepo(t)
+	v100 := repo.release(1, "1.0.0", "linux_amd64")
+	v110 := repo.release(2, "1.1.0", "linux_amd64")
+	repo.publish(t, v110, v100)
+
+	check := func(appVersion string, binary string) (*args.Result, error) {
+		p := &args.Params{AppVersion: appVersion, OS: "linux", Arch: "amd64", Checksum: testChecksum(testBinary("linux_amd64", binary)), MetadataOnly: true}
+		return repo.manager.CheckForUpdate(context.Background(), p)
+	}
+
+	if res, err := check("1.0.0", "1.0.0"); err != nil || res.Version != "1.1.0" {
+		t.Fatalf("before the yank: %+v, %v, want 1.1.0", res, err)
+	}
+
+	// 1.1.0 is yanked, 1.0.0 is the latest again.
+	repo.publish(t, v100)
+
+	tests := []struct {
+		name       string
+		appVersion string
+		binary     string
+	}{
+		{"on the yanked version", "1.1.0", "1.1.0"},
+		{"reporting the yanked version", "1.1.0", "1.0.0"},
+		{"on the latest version", "1.0.0", "1.0.0"},
+	}
+	for _, tt := range tests {
+		if res, err := check(tt.appVersion, tt.binary); err != ErrNoUpdateAvailable {
+			t.Errorf("%s: offered %+v, %v, want no update", tt.name, res, err)
+		}
+	}
+}
+
+// unchangedSource returns its releases once, then ErrNotModified.
+type unchangedSource struct {
+	fakeSource
+	listed bool
+}
+
+func (s *unchangedSource) Releases(owner, repo string) ([]Release, error) {
+	if s.listed {
+		return nil, ErrNotModified
+	}
+	s.listed = true
+	return s.fakeSource.Releases(owner, repo)
+}
+
+// failingClassifier fails to classify assets while failing is set.
+type failingClassifier struct {
+	AssetClassifier
+	failing bool
+}
+
+func (c *failingClassifier) Info(name string) (*AssetInfo, error) {
+	if c.failing {
+		return nil, fmt.Errorf("Could not find asset info.")
+	}
+	return c.AssetClassifier.Info(name)
+}
+
+func TestRefreshRetriesUnclassifiedAssets(t *testing.T) {
+	r := newTestRepo(t)
+	source := new(unchangedSource)
+	source.set(r.release(1, "v1.0.0", "linux_amd64"))
+	r.manager.source = source
+
+	classifier := &failingClassifier{AssetClassifier: assetClassifier, failing: true}
+	saved := assetClassifier
+	t.Cleanup(func() { assetClassifier = saved })
+	assetClassifier = classifier
+
+	summary, err := r.manager.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Failed != 1 || summary.Assets != 0 {
+		t.Fatalf("First refresh: %+v", summary)
+	}
+
+	// The releases did not change, but the asset that failed is retried.
+	classifier.failing = false
+	summary, err = r.manager.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.NotModified || summary.Failed != 0 || summary.Assets != 1 {
+		t.Fatalf("Second refresh: %+v", summary)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// restartFlags are the flags that only take effect on restart when changed in
+// the config file.
+var restartFlags = map[string]bool{
+	"l":             true,
+	"o":             true,
+	"n":             true,
+	"asset":         true,
+	"patch":         true,
+	"token":         true,
+	"github-url":    true,
+	"provider":      true,
+	"gitlab-url":    true,
+	"extra-os":      true,
+	"manifest":      true,
+	"proxy":         true,
+	"storage":       true,
+	"s3-endpoint":   true,
+	"s3-bucket":     true,
+	"s3-access-key": true,
+	"s3-secret-key": true,
+	"s3-public-url": true,
+	"apps":          true,
+	"log-format":    true,
+}
+
+// reloadable holds the settings a reload may change that are read while
+// serving. They are copied from their flags, which reloads write to.
+var reloadable struct {
+	sync.RWMutex
+	publicAddr      string
+	refreshInterval time.Duration
+}
+
+// reloadableSettings is a copy of the reloadable settings.
+type reloadableSettings struct {
+	publicAddr      string
+	refreshInterval time.Duration
+}
+
+// applySettings copies the reloadable settings from their flags.
+func applySettings() {
+	reloadable.Lock()
+	defer reloadable.Unlock()
+	reloadable.publicAddr = *flagPublicAddr
+	reloadable.refreshInterval = *flagRefreshInterval
+}
+
+// settings returns the current reloadable settings.
+func settings() reloadableSettings {
+	reloadable.RLock()
+	defer reloadable.RUnlock()
+	return reloadableSettings{
+		publicAddr:      reloadable.publicAddr,
+		refreshInterval: reloadable.refreshInterval,
+	}
+}
+
+// reload reads the config file and the signing keys again, and signs the
+// known assets with the keys. Settings are left as they were if anything
+// fails. Refreshes wait for it to finish.
+func reload() {
+	// Don't wait for a refresh retrying.
+	interruptRefresh()
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	previous := flagValues()
+	if err := reloadConfig(); err != nil {
+		log.Printf("Could not reload config file %s, keeping the current settings: %s", *flagConfigFile, err)
+		restoreFlags(previous)
+		return
+	}
+
+	signers, err := loadSigningKeys()
+	if err != nil {
+		log.Printf("Could not reload signing keys, keeping the current ones: %s", err)
+		restoreFlags(previous)
+		return
+	}
+
+	for name, value := range flagValues() {
+		if value == previous[name] {
+			continue
+		}
+		if !restartFlags[name] {
+			logger.Info("Reloaded setting", "flag", name)
+			continue
+		}
+		// Keep running with the current value.
+		flag.Set(name, previous[name])
+		if (name == "asset" || name == "patch") && dirPath(value) == previous[name] {
+			continue
+		}
+		logger.Warn("Setting changed, it takes effect on restart", "flag", name)
+	}
+
+	// Everything is valid, switch to the new settings.
+	if *flagAssetPattern != "" {
+		if err = setAssetPattern(*flagAssetPattern); err != nil {
+			log.Printf("Could not apply -asset-pattern: %s", err)
+		}
+	}
+	applySettings()
+
+	apps.Each(func(appID string, m *ReleaseManager) {
+		if err := m.SetSigningKeys(signers); err != nil {
+			log.Printf("Could not sign assets of app %q with the reloaded keys, keeping the current ones: %s", appID, err)
+			return
+		}
+		logger.Info("Reloaded signing keys", "app", appID, "keys", len(signers))
+	})
+}
+
+// reloadConfig applies the config file again, if any.
+func reloadConfig() error {
+	if *flagConfigFile == "" {
+		return nil
+	}
+	config, err := loadConfig(*flagConfigFile)
+	if err != nil {
+		return err
+	}
+	if err = applyConfig(config); err != nil {
+		return err
+	}
+	if *flagAssetPattern != "" {
+		// Applied by reload once the keys are loaded too.
+		if _, err = compileAssetPattern(*flagAssetPattern); err != nil {
+			return fmt.Errorf("invalid -asset-pattern: %s", err)
+		}
+	}
+	return nil
+}
+
+// flagValues returns the values of the flags that can be set from the config
+// file.
+func flagValues() map[string]string {
+	values := make(map[string]string, len(configFlags))
+	for _, cf := range configFlags {
+		values[cf.flag] = flag.Lookup(cf.flag).Value.String()
+	}
+	return values
+}
+
+// restoreFlags sets flags back to values returned by flagValues.
+func restoreFlags(values map[string]string) {
+	for name, value := range values {
+		flag.Set(name, value)
+	}
+}
+
+// SetSigningKeys signs all known assets again with signers, which then sign
+// the assets found from now on. The current keys are kept if an asset cannot
+// be signed.
+func (g *ReleaseManager) SetSigningKeys(signers []crypto.Signer) error {
+	var assets []*Asset
+	g.mu.RLock()
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			for _, a := range g.updateAssetsMap[os][arch] {
+				assets = append(assets, a)
+			}
+		}
+	}
+	g.mu.RUnlock()
+
+	// Assets are copied as update checks may be reading them.
+	signed := make(map[*Asset]*Asset, len(assets))
+	for _, a := range assets {
+		s := *a
+		var err error
+		if s.Signature, s.signatures, err = signaturesForFile(a.LocalFile, signers); err != nil {
+			return err
+		}
+		signed[a] = &s
+	}
+
+	g.mu.Lock()
+	g.signers = signers
+	for _, byOS := range []map[string]map[string]map[string]*Asset{g.updateAssetsMap, g.latestAssetsMap} {
+		for os := range byOS {
+			for arch := range byOS[os] {
+				for k, a := range byOS[os][arch] {
+					if s, ok := signed[a]; ok {
+						byOS[os][arch][k] = s
+					}
+				}
+			}
+		}
+	}
+	g.mu.Unlock()
+
+	return g.saveCache()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+const fullRollout = 100
+
+var rolloutRe = regexp.MustCompile(`(?mi)^\s*rollout:\s*(\d+)\s*%?\s*$`)
+
+var rampRe = regexp.MustCompile(`(?mi)^\s*ramp:\s*(\d+)\s*%?\s+to\s+(\d+)\s*%?\s+over\s+(\S+)(?:\s+from\s+(\S+))?\s*$`)
+
+var mandatoryRe = regexp.MustCompile(`(?mi)^\s*mandatory:\s*(?:true|yes)\s*$`)
+
+// rampSchedule raises the rollout percentage of a release linearly from From
+// to To over Duration, starting at Start.
+type rampSchedule struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	From     int           `json:"from"`
+	To       int           `json:"to"`
+}
+
+// parseRamp looks for a "ramp: 1% to 100% over 24h" line in a release body,
+// optionally followed by "from 2006-01-02T15:04:05Z" to start the ramp at
+// another time than published. It returns nil if there is none.
+func parseRamp(body string, published time.Time) *rampSchedule {
+	matches := rampRe.FindStringSubmatch(body)
+	if len(matches) < 5 {
+		return nil
+	}
+	from, err := strconv.Atoi(matches[1])
+	if err != nil || from > fullRollout {
+		return nil
+	}
+	to, err := strconv.Atoi(matches[2])
+	if err != nil || to > fullRollout {
+		return nil
+	}
+	duration, err := time.ParseDuration(matches[3])
+	if err != nil || duration <= 0 {
+		return nil
+	}
+	start := published
+	if matches[4] != "" {
+		if start, err = time.Parse(time.RFC3339, matches[4]); err != nil {
+			return nil
+		}
+	}
+	return &rampSchedule{Start: start, Duration: duration, From: from, To: to}
+}
+
+// percent returns the rollout percentage at t.
+func (r *rampSchedule) percent(t time.Time) int {
+	elapsed := t.Sub(r.Start)
+	switch {
+	case elapsed <= 0:
+		return r.From
+	case elapsed >= r.Duration:
+		return r.To
+	}
+	return r.From + int(int64(r.To-r.From)*int64(elapsed)/int64(r.Duration))
+}
+
+// parseRollout looks for a "rollout: N" line in a release body and returns
+// the percentage of clients the release should be offered to.
+func parseRollout(body string) int {
+	matches := rolloutRe.FindStringSubmatch(body)
+	if len(matches) < 2 {
+		return fullRollout
+	}
+	n, err := strconv.Atoi(matches[1])
+	if err != nil || n > fullRollout {
+		return fullRollout
+	}
+	return n
+}
+
+// parseMandatory tells whether a release body has a "mandatory: true" line,
+// making clients apply the release without letting users postpone it.
+func parseMandatory(body string) bool {
+	return mandatoryRe.MatchString(body)
+}
+
+// inRollout tells whether the given user falls within the first percent
+// of clients offered version v. The decision is stable for a user/version
+// pair.
+func inRollout(userID string, v semver.Version, percent int) bool {
+	if percent >= fullRollout {
+		return true
+	}
+	if userID == "" || percent <= 0 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(userID + "|" + v.String()))
+	return binary.BigEndian.Uint64(sum[:8])%fullRollout < uint64(percent)
+}
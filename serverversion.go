@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+// versionHandler tells which build of the server is running and what it
+// serves:
+//
+//	GET /version
+type versionHandler struct{}
+
+// serverVersion is the answer of versionHandler.
+type serverVersion struct {
+	Version   string                `json:"version"`
+	Commit    string                `json:"commit"`
+	BuildDate string                `json:"build_date"`
+	Apps      map[string]appVersion `json:"apps"`
+}
+
+// appVersion describes what the server serves for an application.
+type appVersion struct {
+	Repo     string   `json:"repo"`
+	Channels []string `json:"channels"`
+}
+
+func (h *versionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, args.ERROR_METHOD_NOT_ALLOWED, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	v := serverVersion{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		Apps:      make(map[string]appVersion),
+	}
+	apps.Each(func(appID string, m *ReleaseManager) {
+		v.Apps[appID] = appVersion{Repo: m.Repo(), Channels: m.Channels()}
+	})
+
+	writeJSON(w, v)
+}
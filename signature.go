@@ -2,12 +2,19 @@ package main
 
 import (
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/getlantern/go-update"
+	"github.com/yinghuocho/autoupdate-server/args"
+	"github.com/yinghuocho/autoupdate-server/verify"
 )
 
 func checksumForFile(file string) (string, []byte, error) {
@@ -20,17 +27,156 @@ func checksumForFile(file string) (string, []byte, error) {
 	return checksumHex, checksum, nil
 }
 
-func signatureForFile(file string, privKey *rsa.PrivateKey) (string, error) {
+// checksumsForFile computes the checksums of a file with all supported
+// algorithms.
+func checksumsForFile(file string) (map[args.ChecksumAlgorithm]string, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	h256 := sha256.New()
+	h512 := sha512.New()
+	if _, err = io.Copy(io.MultiWriter(h256, h512), fp); err != nil {
+		return nil, err
+	}
+
+	return map[args.ChecksumAlgorithm]string{
+		args.CHECKSUM_SHA256: hex.EncodeToString(h256.Sum(nil)),
+		args.CHECKSUM_SHA512: hex.EncodeToString(h512.Sum(nil)),
+	}, nil
+}
+
+// signingSelfTest is the payload checkSigningKey signs.
+var signingSelfTest = []byte("autoupdate-server signing self-test")
+
+// checkSigningKey makes sure signatures made with signer verify with its
+// public key, and with pubKey if given, as clients would verify them.
+func checkSigningKey(signer crypto.Signer, pubKey crypto.PublicKey) error {
+	if privKey, ok := signer.(*rsa.PrivateKey); ok {
+		if err := privKey.Validate(); err != nil {
+			return err
+		}
+	}
+
+	checksum := sha256.Sum256(signingSelfTest)
+	signature, err := signDigest(signer, checksum[:])
+	if err != nil {
+		return fmt.Errorf("Could not sign test payload: %q", err)
+	}
+
+	if err = verify.Signature(checksum[:], signature, signer.Public()); err != nil {
+		return fmt.Errorf("Could not verify test signature: %q", err)
+	}
+
+	if pubKey != nil {
+		if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(pubKey) {
+			return fmt.Errorf("Public key does not match the private key.")
+		}
+	}
+
+	return nil
+}
+
+// signDigest signs a SHA256 digest with signer, PKCS #1 v1.5 for RSA keys.
+// Ed25519 keys sign the digest itself.
+func signDigest(signer crypto.Signer, digest []byte) ([]byte, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	return signer.Sign(rand.Reader, digest, opts)
+}
+
+func signatureForFile(file string, signer crypto.Signer) (string, error) {
 	_, checksum, err := checksumForFile(file)
 	if err != nil {
 		return "", err
 	}
 
 	// Checking message signature.
-	signature, err := rsa.SignPKCS1v15(rand.Reader, privKey, crypto.SHA256, checksum)
+	signature, err := signDigest(signer, checksum)
 	if err != nil {
 		return "", fmt.Errorf("Could not create signature for file %s: %q", file, err)
 	}
 
 	return hex.EncodeToString(signature), nil
 }
+
+// verifyFile signs file the way assets are signed and checks the signature
+// the way clients do, with the public key of signer and with pubKey if given.
+// It writes the checksum, the signature and the outcome to w.
+func verifyFile(w io.Writer, file string, signer crypto.Signer, pubKey crypto.PublicKey) error {
+	checksum, _, err := checksumForFile(file)
+	if err != nil {
+		return err
+	}
+	signature, err := signatureForFile(file, signer)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "checksum:  %s\n", checksum)
+	fmt.Fprintf(w, "signature: %s\n", signature)
+
+	keys := []crypto.PublicKey{signer.Public()}
+	if pubKey != nil {
+		keys = append(keys, pubKey)
+	}
+	for i, key := range keys {
+		name := "signer key"
+		if i > 0 {
+			name = "public key"
+		}
+		if err = verify.File(file, checksum, signature, key); err != nil {
+			fmt.Fprintf(w, "%s: FAILED (%s)\n", name, err)
+			return fmt.Errorf("Signature does not verify with the %s.", name)
+		}
+		fmt.Fprintf(w, "%s: OK\n", name)
+	}
+	return nil
+}
+
+// signatureForBytes signs the SHA256 checksum of b with signer.
+func signatureForBytes(b []byte, signer crypto.Signer) (string, error) {
+	checksum := sha256.Sum256(b)
+	signature, err := signDigest(signer, checksum[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(signature), nil
+}
+
+// signaturesForFile signs file with each of signers. It returns the
+// signature made with the first one, and if there are several the signatures
+// made with each of them by key ID.
+func signaturesForFile(file string, signers []crypto.Signer) (string, map[string]string, error) {
+	if len(signers) == 0 {
+		return "", nil, fmt.Errorf("No signing key.")
+	}
+
+	var signatures map[string]string
+	if len(signers) > 1 {
+		signatures = make(map[string]string, len(signers))
+	}
+
+	var first string
+	for i, signer := range signers {
+		signature, err := signatureForFile(file, signer)
+		if err != nil {
+			return "", nil, err
+		}
+		if i == 0 {
+			first = signature
+		}
+		if signatures != nil {
+			id, err := verify.KeyID(signer.Public())
+			if err != nil {
+				return "", nil, err
+			}
+			signatures[id] = signature
+		}
+	}
+
+	return first, signatures, nil
+}
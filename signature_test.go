@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/yinghuocho/autoupdate-server/verify"
+)
+
+// TestSignaturesVerify checks that clients using the verify package accept
+// what the server signs.
+func TestSignaturesVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "update")
+	if err = ioutil.WriteFile(file, []byte("update binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksum, _, err := checksumForFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, signer := range map[string]crypto.Signer{"rsa": rsaKey, "ed25519": edKey} {
+		signature, err := signatureForFile(file, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = verify.File(file, checksum, signature, signer.Public()); err != nil {
+			t.Errorf("%s: asset signature does not verify: %v", name, err)
+		}
+
+		body := []byte(`{"version":"1.1.0"}`)
+		if signature, err = signatureForBytes(body, signer); err != nil {
+			t.Fatal(err)
+		}
+		if err = verify.Response(body, signature, signer.Public()); err != nil {
+			t.Errorf("%s: response signature does not verify: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// signerProviders create the signers -signer may name.
+var signerProviders = map[string]func() (crypto.Signer, error){
+	"pem": func() (crypto.Signer, error) {
+		return loadPrivateKey(*flagPrivateKey)
+	},
+	"command": func() (crypto.Signer, error) {
+		if *flagPublicKey == "" {
+			return nil, fmt.Errorf("-signer command needs -pubkey")
+		}
+		pub, err := loadPublicKey(*flagPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return newCommandSigner(*flagSignerCommand, pub)
+	},
+}
+
+// newSigner creates the signer named name.
+func newSigner(name string) (crypto.Signer, error) {
+	provider := signerProviders[name]
+	if provider == nil {
+		return nil, fmt.Errorf("unknown signer %q, expecting pem or command", name)
+	}
+	return provider()
+}
+
+// commandSigner signs digests with an external program, which may keep the
+// key in a KMS or HSM. The program reads the hex encoded digest on stdin and
+// writes the hex encoded signature on stdout.
+type commandSigner struct {
+	args []string
+	pub  crypto.PublicKey
+}
+
+// newCommandSigner creates a commandSigner running command, whose signatures
+// verify with pub.
+func newCommandSigner(command string, pub crypto.PublicKey) (*commandSigner, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("-signer command needs -signer-command")
+	}
+	return &commandSigner{args: args, pub: pub}, nil
+}
+
+func (s *commandSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs digest, the program is expected to use opts as fits its key.
+func (s *commandSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(s.args[0], s.args[1:]...)
+	cmd.Stdin = strings.NewReader(hex.EncodeToString(digest) + "\n")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign with %s: %q %s", s.args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return hex.DecodeString(strings.TrimSpace(string(out)))
+}
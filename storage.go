@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// presignExpiry is how long presigned patch URLs stay valid.
+const presignExpiry = 24 * time.Hour
+
+// Storage holds files shared by all server instances. Assets and patches
+// are still worked on from the local asset and patch directories, Storage
+// is where they are published to and looked up from.
+type Storage interface {
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	Exists(name string) (bool, error)
+	// Delete removes name, if it is there.
+	Delete(name string) error
+	// URL tells where clients download name from, or "" if it is served by
+	// this server.
+	URL(name string) (string, error)
+}
+
+var (
+	// assetStorage is where downloaded assets are published.
+	assetStorage Storage
+	// patchStorage is where generated patches are published.
+	patchStorage Storage
+)
+
+// diskStorage is a Storage keeping files in a local directory.
+type diskStorage struct {
+	dir string
+}
+
+func (s *diskStorage) path(name string) string {
+	return s.dir + path.Base(name)
+}
+
+func (s *diskStorage) Put(name string, r io.Reader) (err error) {
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(s.dir, ".put-"); err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(name))
+}
+
+func (s *diskStorage) Get(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *diskStorage) Exists(name string) (bool, error) {
+	fi, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.Mode().IsRegular(), nil
+}
+
+func (s *diskStorage) Delete(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *diskStorage) URL(name string) (string, error) {
+	return "", nil
+}
+
+// s3Storage is a Storage keeping files in an S3 compatible bucket, under
+// prefix.
+type s3Storage struct {
+	client    *minio.Client
+	bucket    string
+	prefix    string
+	publicURL string
+}
+
+// newS3Storage creates a Storage for the bucket at endpoint. Files are
+// downloaded from publicURL if given, or from presigned URLs.
+func newS3Storage(base http.RoundTripper, endpoint string, bucket string, accessKey string, secretKey string, prefix string, publicURL string) (*s3Storage, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		// A bare host name.
+		u = &url.URL{Scheme: "https", Host: endpoint}
+	}
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:     credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure:    u.Scheme != "http",
+		Transport: base,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if publicURL != "" && !strings.HasSuffix(publicURL, "/") {
+		publicURL += "/"
+	}
+	return &s3Storage{
+		client:    client,
+		bucket:    bucket,
+		prefix:    prefix,
+		publicURL: publicURL,
+	}, nil
+}
+
+func (s *s3Storage) Put(name string, r io.Reader) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.prefix+name, r, -1, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (s *s3Storage) Get(name string) (io.ReadCloser, error) {
+	return s.client.GetObject(context.Background(), s.bucket, s.prefix+name, minio.GetObjectOptions{})
+}
+
+func (s *s3Storage) Exists(name string) (bool, error) {
+	_, err := s.client.StatObject(context.Background(), s.bucket, s.prefix+name, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.prefix+name, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) URL(name string) (string, error) {
+	if s.publicURL != "" {
+		return s.publicURL + s.prefix + name, nil
+	}
+	u, err := s.client.PresignedGetObject(context.Background(), s.bucket, s.prefix+name, presignExpiry, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// isLocalCopy tells whether localfile is in the directory st keeps name in,
+// in which case there is nothing to copy either way.
+func isLocalCopy(st Storage, name string, localfile string) bool {
+	d, ok := st.(*diskStorage)
+	return ok && path.Dir(d.path(name)) == path.Dir(localfile)
+}
+
+// storeFile publishes localfile to st under name.
+func storeFile(st Storage, name string, localfile string) error {
+	if isLocalCopy(st, name, localfile) {
+		return nil
+	}
+	fp, err := os.Open(localfile)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return st.Put(name, fp)
+}
+
+// fetchFile copies name from st into localfile. It tells whether st holds
+// name.
+func fetchFile(st Storage, name string, localfile string) (found bool, err error) {
+	if isLocalCopy(st, name, localfile) {
+		return false, nil
+	}
+	if found, err = st.Exists(name); !found || err != nil {
+		return false, err
+	}
+
+	var rc io.ReadCloser
+	if rc, err = st.Get(name); err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	var fp *os.File
+	if fp, err = os.Create(localfile); err != nil {
+		return false, err
+	}
+	if _, err = io.Copy(fp, rc); err != nil {
+		fp.Close()
+		os.Remove(localfile)
+		return false, err
+	}
+	return true, fp.Close()
+}
+
+// publishFile stores localfile in st. Failures are logged too, the local copy
+// is still usable.
+func publishFile(st Storage, localfile string) error {
+	err := storeFile(st, path.Base(localfile), localfile)
+	if err != nil {
+		log.Printf("Could not store %s: %q", localfile, err)
+	}
+	return err
+}
+
+// unpublished holds the names of the patches that could not be stored in the
+// patch storage, which are served from the patch directory instead.
+var unpublished = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// publishPatch stores patchfile in the patch storage, remembering whether it
+// could be.
+func publishPatch(patchfile string) {
+	err := publishFile(patchStorage, patchfile)
+	name := path.Base(patchfile)
+	unpublished.Lock()
+	defer unpublished.Unlock()
+	if err != nil {
+		unpublished.names[name] = true
+	} else {
+		delete(unpublished.names, name)
+	}
+}
+
+// isUnpublished tells whether the named patch could not be stored in the
+// patch storage.
+func isUnpublished(name string) bool {
+	unpublished.RLock()
+	defer unpublished.RUnlock()
+	return unpublished.names[name]
+}
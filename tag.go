@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+// TagParser maps release tags to versions, which order releases.
+type TagParser interface {
+	ParseTag(tag string) (semver.Version, error)
+}
+
+// tagParser parses the tags of all releases, see -tag-format.
+var tagParser TagParser = semverTags{}
+
+// semverTags parses semantic versions, optionally prefixed with v.
+type semverTags struct{}
+
+func (semverTags) ParseTag(tag string) (semver.Version, error) {
+	return parseVersion(tag)
+}
+
+// dateTagRe finds a date in a tag, possibly followed by a build number, e.g.
+// build-20240115, 2024-01-15 or release-20240115.2.
+var dateTagRe = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})(?:[.-](\d+))?$`)
+
+// dateTags parses dated tags into YYYYMMDD.N.0 versions, N being the build
+// number of the day, 0 if there is none.
+type dateTags struct{}
+
+func (dateTags) ParseTag(tag string) (semver.Version, error) {
+	matches := dateTagRe.FindStringSubmatch(tag)
+	if matches == nil {
+		return semver.Version{}, fmt.Errorf("No date in tag %q.", tag)
+	}
+	date, err := time.Parse("20060102", matches[1]+matches[2]+matches[3])
+	if err != nil {
+		return semver.Version{}, err
+	}
+	v := semver.Version{Major: uint64(date.Year()*10000 + int(date.Month())*100 + date.Day())}
+	if matches[4] != "" {
+		if v.Minor, err = strconv.ParseUint(matches[4], 10, 64); err != nil {
+			return semver.Version{}, err
+		}
+	}
+	return v, nil
+}
+
+// regexpTags parses tags with a regexp having major, and optionally minor,
+// patch and pre named groups.
+type regexpTags struct {
+	re *regexp.Regexp
+}
+
+// newRegexpTags compiles pattern into a regexpTags.
+func newRegexpTags(pattern string) (*regexpTags, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("major") < 0 {
+		return nil, fmt.Errorf("missing (?P<major>...) group")
+	}
+	return &regexpTags{re: re}, nil
+}
+
+func (t *regexpTags) ParseTag(tag string) (semver.Version, error) {
+	matches := t.re.FindStringSubmatch(tag)
+	if matches == nil {
+		return semver.Version{}, fmt.Errorf("Tag %q does not match.", tag)
+	}
+	group := func(name string) string {
+		if i := t.re.SubexpIndex(name); i >= 0 {
+			return matches[i]
+		}
+		return ""
+	}
+	s := group("major")
+	for _, name := range []string{"minor", "patch"} {
+		if n := group(name); n != "" {
+			s += "." + n
+		} else {
+			s += ".0"
+		}
+	}
+	if pre := group("pre"); pre != "" {
+		s += "-" + pre
+	}
+	return semver.Parse(s)
+}
+
+// newTagParser returns the TagParser for a -tag-format, pattern being the
+// -tag-pattern of the regexp format.
+func newTagParser(format string, pattern string) (TagParser, error) {
+	switch format {
+	case "semver":
+		return semverTags{}, nil
+	case "date":
+		return dateTags{}, nil
+	case "regexp":
+		if pattern == "" {
+			return nil, fmt.Errorf("-tag-format regexp needs -tag-pattern")
+		}
+		return newRegexpTags(pattern)
+	}
+	return nil, fmt.Errorf("unknown -tag-format %q, expecting semver, date or regexp", format)
+}
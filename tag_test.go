@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSemverTags(t *testing.T) {
+	tests := []struct {
+		tag     string
+		version string
+	}{
+		{"v1.2.3", "1.2.3"},
+		{"V1.2.3", "1.2.3"},
+		{"1.2.3", "1.2.3"},
+		{"v1.2.3-beta.1", "1.2.3-beta.1"},
+		{"release-1.2.3", ""},
+		{"v1.2", ""},
+		{"vv1.2.3", ""},
+		{"latest", ""},
+	}
+
+	for _, tt := range tests {
+		v, err := semverTags{}.ParseTag(tt.tag)
+		if tt.version == "" {
+			if err == nil {
+				t.Errorf("ParseTag(%q) = %s, want an error", tt.tag, v)
+			}
+			continue
+		}
+		if err != nil || v.String() != tt.version {
+			t.Errorf("ParseTag(%q) = %s, %v, want %s", tt.tag, v, err, tt.version)
+		}
+	}
+}
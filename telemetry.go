@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+const (
+	// fleetSlots is the number of slots the telemetry window is divided in,
+	// counts expire a slot at a time.
+	fleetSlots = 24
+	// maxFleetKeys bounds the distinct app/version/os/arch combinations
+	// counted per slot, clients may send any version.
+	maxFleetKeys = 1000
+)
+
+var (
+	// fleetWindow is the window update checks are counted over, they are not
+	// counted if 0.
+	fleetWindow = 24 * time.Hour
+	// fleet counts the update checks of clients by version, os and arch over
+	// a rolling window.
+	fleet = newFleetCounts(fleetWindow)
+)
+
+// fleetKey is what update checks are counted by.
+type fleetKey struct {
+	App     string
+	Version string
+	OS      string
+	Arch    string
+}
+
+// fleetSlot holds the counts of a part of the window.
+type fleetSlot struct {
+	start  time.Time
+	counts map[fleetKey]int
+}
+
+// fleetCounts counts update checks in slots, the oldest ones being dropped as
+// the window rolls.
+type fleetCounts struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	slots []*fleetSlot
+}
+
+func newFleetCounts(window time.Duration) *fleetCounts {
+	return &fleetCounts{window: window}
+}
+
+// setWindow changes the window counts are kept over, dropping the counts.
+func (f *fleetCounts) setWindow(window time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.window = window
+	f.slots = nil
+}
+
+// record counts an update check. Checks for unknown platforms or with a
+// version that is not semantic are not counted.
+func (f *fleetCounts) record(p *args.Params) {
+	if !contains(knownOSes, p.OS) || !contains(knownArchs, p.Arch) {
+		return
+	}
+	v, err := semver.Parse(p.AppVersion)
+	if err != nil {
+		return
+	}
+	key := fleetKey{App: p.AppId, Version: v.String(), OS: p.OS, Arch: p.Arch}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.expire(now)
+	slotLen := f.window / fleetSlots
+	if len(f.slots) == 0 || now.Sub(f.slots[len(f.slots)-1].start) >= slotLen {
+		f.slots = append(f.slots, &fleetSlot{start: now.Truncate(slotLen), counts: make(map[fleetKey]int)})
+	}
+	slot := f.slots[len(f.slots)-1]
+	if _, ok := slot.counts[key]; !ok && len(slot.counts) >= maxFleetKeys {
+		return
+	}
+	slot.counts[key]++
+}
+
+// expire drops the slots that ended before the window.
+func (f *fleetCounts) expire(now time.Time) {
+	slotLen := f.window / fleetSlots
+	i := 0
+	for i < len(f.slots) && now.Sub(f.slots[i].start) >= f.window+slotLen {
+		i++
+	}
+	f.slots = f.slots[i:]
+}
+
+// FleetCount is the number of update checks made by clients of a version on
+// a platform.
+type FleetCount struct {
+	App     string `json:"app"`
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Checks  int    `json:"checks"`
+}
+
+// fleetReport is the answer of fleetHandler.
+type fleetReport struct {
+	Since  time.Time    `json:"since"`
+	Counts []FleetCount `json:"counts"`
+}
+
+// report sums the counts of the window, most checks first.
+func (f *fleetCounts) report() fleetReport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.expire(now)
+	report := fleetReport{Since: now.Add(-f.window), Counts: []FleetCount{}}
+	if len(f.slots) > 0 && f.slots[0].start.After(report.Since) {
+		report.Since = f.slots[0].start
+	}
+
+	totals := make(map[fleetKey]int)
+	for _, slot := range f.slots {
+		for key, n := range slot.counts {
+			totals[key] += n
+		}
+	}
+	for key, n := range totals {
+		report.Counts = append(report.Counts, FleetCount{App: key.App, Version: key.Version, OS: key.OS, Arch: key.Arch, Checks: n})
+	}
+	sort.Slice(report.Counts, func(i, j int) bool {
+		a, b := report.Counts[i], report.Counts[j]
+		if a.Checks != b.Checks {
+			return a.Checks > b.Checks
+		}
+		if a.App != b.App {
+			return a.App < b.App
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		if a.OS != b.OS {
+			return a.OS < b.OS
+		}
+		return a.Arch < b.Arch
+	})
+	return report
+}
+
+// fleetHandler reports how many update checks clients of each version, os
+// and arch made over the telemetry window.
+type fleetHandler struct{}
+
+func (h *fleetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeStatus(w, http.StatusNotFound)
+		return
+	}
+
+	if !authorized(r) {
+		writeStatus(w, http.StatusForbidden)
+		return
+	}
+
+	writeJSON(w, fleet.report())
+}
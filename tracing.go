@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the server. Spans are not recorded unless
+// setupTracing is called with an endpoint, it then uses the exporter set up.
+var tracer = otel.Tracer("github.com/yinghuocho/autoupdate-server")
+
+// setupTracing exports spans to the OTLP/HTTP collector at endpoint, e.g.
+// http://localhost:4318, and picks up the trace context of incoming requests.
+// It does nothing if endpoint is empty. The returned function flushes
+// pending spans.
+func setupTracing(ctx context.Context, endpoint string) (shutdown func(context.Context) error, err error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// traceResult annotates the span of an update check with its outcome.
+func traceResult(span trace.Span, res *args.Result, err error) {
+	switch {
+	case err == ErrNoUpdateAvailable:
+		span.SetAttributes(attribute.String("result", "no_update"))
+	case err != nil:
+		span.SetAttributes(attribute.String("result", string(errorCode(err))))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	default:
+		patchType := string(res.PatchType)
+		if patchType == "" {
+			patchType = "none"
+		}
+		span.SetAttributes(
+			attribute.String("result", "update"),
+			attribute.String("patch_type", patchType),
+			attribute.String("to_version", res.Version),
+		)
+	}
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
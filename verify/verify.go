@@ -0,0 +1,112 @@
+// Package verify checks downloaded updates the way the autoupdate server
+// signs them: the signature is made over the SHA256 checksum of the binary.
+package verify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	ErrChecksumMismatch = errors.New(`File does not match the checksum`)
+	ErrBadSignature     = errors.New(`Signature does not match the file`)
+)
+
+// File checks that the file at path is the one described by an update
+// result: that it matches checksum, a hex encoded SHA256 or SHA512 checksum
+// as found in Result.Checksum, and that signature, hex encoded as found in
+// Result.Signature, was made by the key pub is the public part of. pub is an
+// *rsa.PublicKey or an ed25519.PublicKey. It returns nil if the file is
+// authentic.
+func File(path string, checksum string, signature string, pub crypto.PublicKey) error {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("Could not decode signature: %q", err)
+	}
+
+	expected, err := hex.DecodeString(checksum)
+	if err != nil {
+		return fmt.Errorf("Could not decode checksum: %q", err)
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	h256 := sha256.New()
+	h512 := sha512.New()
+	if _, err = io.Copy(io.MultiWriter(h256, h512), fp); err != nil {
+		return err
+	}
+
+	// The signature is always made over the SHA256 checksum.
+	digest := h256.Sum(nil)
+
+	var sum []byte
+	switch len(expected) {
+	case sha256.Size:
+		sum = digest
+	case sha512.Size:
+		sum = h512.Sum(nil)
+	default:
+		return fmt.Errorf("Unsupported checksum length %d.", len(expected))
+	}
+	if !bytes.Equal(sum, expected) {
+		return ErrChecksumMismatch
+	}
+
+	return Signature(digest, sig, pub)
+}
+
+// Response checks that signature, hex encoded as found in the X-Signature
+// header of an update response, was made over body, the response body once
+// decompressed, by the key pub is the public part of.
+func Response(body []byte, signature string, pub crypto.PublicKey) error {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("Could not decode signature: %q", err)
+	}
+	digest := sha256.Sum256(body)
+	return Signature(digest[:], sig, pub)
+}
+
+// KeyID identifies the public key pub in Result.Signatures: it is the hex
+// encoded first 8 bytes of the SHA256 checksum of its PKIX encoding.
+func KeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// Signature checks that sig is a signature of the SHA256 digest of a file by
+// the key pub is the public part of.
+func Signature(digest []byte, sig []byte, pub crypto.PublicKey) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig) != nil {
+			return ErrBadSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, sig) {
+			return ErrBadSignature
+		}
+	default:
+		return fmt.Errorf("Unsupported public key type %T.", pub)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package verify
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// sign signs the SHA256 digest of b the way the server does.
+func sign(t *testing.T, signer crypto.Signer, b []byte) string {
+	digest := sha256.Sum256(b)
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+	sig, err := signer.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(sig)
+}
+
+func TestFile(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("update binary")
+	file := filepath.Join(t.TempDir(), "update")
+	if err = ioutil.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum256 := sha256.Sum256(content)
+	sum512 := sha512.Sum512(content)
+	other := sha256.Sum256([]byte("another binary"))
+
+	for _, k := range []struct {
+		name   string
+		signer crypto.Signer
+		other  crypto.PublicKey
+	}{
+		{"rsa", rsaKey, edKey.Public()},
+		{"ed25519", edKey, rsaKey.Public()},
+	} {
+		signer := k.signer
+		signature := sign(t, signer, content)
+		tests := []struct {
+			name      string
+			checksum  string
+			signature string
+			pub       crypto.PublicKey
+			err       error
+		}{
+			{"sha256", hex.EncodeToString(sum256[:]), signature, signer.Public(), nil},
+			{"sha512", hex.EncodeToString(sum512[:]), signature, signer.Public(), nil},
+			{"other checksum", hex.EncodeToString(other[:]), signature, signer.Public(), ErrChecksumMismatch},
+			{"other signature", hex.EncodeToString(sum256[:]), sign(t, signer, []byte("another binary")), signer.Public(), ErrBadSignature},
+			{"other key", hex.EncodeToString(sum256[:]), signature, k.other, ErrBadSignature},
+		}
+		for _, tt := range tests {
+			if err := File(file, tt.checksum, tt.signature, tt.pub); err != tt.err {
+				t.Errorf("%s, %s: File = %v, want %v", k.name, tt.name, err, tt.err)
+			}
+		}
+	}
+
+	if err := File(file, "not hex", sign(t, edKey, content), edKey.Public()); err == nil {
+		t.Error("File accepted a checksum that is not hex")
+	}
+	if err := File(file, hex.EncodeToString(sum256[:]), "not hex", edKey.Public()); err == nil {
+		t.Error("File accepted a signature that is not hex")
+	}
+}
+
+func TestResponse(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"version":"1.1.0"}`)
+	signature := sign(t, key, body)
+
+	if err = Response(body, signature, key.Public()); err != nil {
+		t.Errorf("Response = %v, want nil", err)
+	}
+	if err = Response([]byte(`{"version":"9.9.9"}`), signature, key.Public()); err != ErrBadSignature {
+		t.Errorf("Response of a forged body = %v, want %v", err, ErrBadSignature)
+	}
+	// "No update" responses have an empty body.
+	if err = Response(nil, sign(t, key, nil), key.Public()); err != nil {
+		t.Errorf("Response of an empty body = %v, want nil", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/yinghuocho/autoupdate-server/args"
+)
+
+const (
+	defaultVersionsLimit = 20
+	maxVersionsLimit     = 100
+)
+
+// versionsHandler lists the versions available for a platform, newest first,
+// a page at a time:
+//
+//	GET /versions?os=linux&arch=amd64&offset=0&limit=20
+type versionsHandler struct{}
+
+// versionsPage is a page of the versions available for a platform.
+type versionsPage struct {
+	Total    int              `json:"total"`
+	Offset   int              `json:"offset"`
+	Versions []VersionSummary `json:"versions"`
+}
+
+func (h *versionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, args.ERROR_METHOD_NOT_ALLOWED, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("os") == "" {
+		writeError(w, http.StatusBadRequest, args.ERROR_MISSING_OS, "OS is required")
+		return
+	}
+	if q.Get("arch") == "" {
+		writeError(w, http.StatusBadRequest, args.ERROR_MISSING_ARCH, "Arch is required")
+		return
+	}
+
+	offset, limit := 0, defaultVersionsLimit
+	var err error
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, args.ERROR_BAD_REQUEST, "Bad offset: "+s)
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, args.ERROR_BAD_REQUEST, "Bad limit: "+s)
+			return
+		}
+	}
+	if limit > maxVersionsLimit {
+		limit = maxVersionsLimit
+	}
+
+	m, err := apps.Get(q.Get("app"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errorCode(err), err.Error())
+		return
+	}
+
+	versions := m.ListVersions(q.Get("os"), q.Get("arch"))
+	page := versionsPage{
+		Total:    len(versions),
+		Offset:   offset,
+		Versions: []VersionSummary{},
+	}
+	if offset < len(versions) {
+		end := offset + limit
+		if end > len(versions) {
+			end = len(versions)
+		}
+		page.Versions = versions[offset:end]
+	}
+
+	writeJSON(w, page)
+}